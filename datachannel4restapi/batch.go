@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// A batch is an array of request envelopes sent as one message:
+//
+//	[{"id": "a", "method": "GET", "endpoint": "/api/users"},
+//	 {"id": "b", "method": "GET", "endpoint": "/api/health"}]
+//
+// It is answered with one message holding an array of responses in the same
+// order. Each response has its own status, so one failing request does not
+// fail the others. The requests run in parallel, except that a request with
+// "ordered": true starts only once every request before it has finished.
+// Binary bodies cannot follow as body frames, so they are embedded as base64
+// strings and marked with Content-Transfer-Encoding.
+const maxBatchSize = 100
+
+// isBatch tells from its first byte whether msg is a batch rather than a
+// single request, so that it can be charged to the rate limit before it is
+// decoded.
+func (rc *restChannel) isBatch(msg webrtc.DataChannelMessage) bool {
+	if msg.IsString || len(msg.Data) == 0 || msg.Data[0] != frameEnvelope {
+		data := bytes.TrimLeft(msg.Data, " \t\r\n")
+		return len(data) > 0 && data[0] == '['
+	}
+	codec := rc.codec.Load()
+	return codec != nil && len(msg.Data) > 1 && codec.startsArray(msg.Data[1])
+}
+
+// decodeBatch returns the requests of a batch message as JSON.
+func (rc *restChannel) decodeBatch(msg webrtc.DataChannelMessage) ([]json.RawMessage, error) {
+	data := msg.Data
+	if !msg.IsString && len(data) > 0 && data[0] == frameEnvelope {
+		var generic []interface{}
+		if err := rc.codec.Load().unmarshal(data[1:], &generic); err != nil {
+			return nil, err
+		}
+		var err error
+		if data, err = json.Marshal(generic); err != nil {
+			return nil, err
+		}
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// handleBatch runs the requests of a batch and sends back their responses
+// once all of them are done.
+func (rc *restChannel) handleBatch(msg webrtc.DataChannelMessage) {
+	items, err := rc.decodeBatch(msg)
+	if err != nil {
+		rc.reply("", newProblem(http.StatusBadRequest, problemMalformedRequest, "Invalid batch: "+err.Error()).Response())
+		return
+	}
+	switch {
+	case len(items) == 0:
+		rc.reply("", newProblem(http.StatusBadRequest, problemMalformedRequest, "Batch is empty").Response())
+		return
+	case len(items) > maxBatchSize:
+		rc.reply("", newProblem(http.StatusRequestEntityTooLarge, problemTooLarge,
+			fmt.Sprintf("Batch holds more than %d requests", maxBatchSize)).Response())
+		return
+	}
+	log.Printf("📦 Received batch of %d requests", len(items))
+
+	go func() {
+		responses := make([]RestAPIResponse, len(items))
+		var wg sync.WaitGroup
+		for i, item := range items {
+			var request RestAPIMessage
+			if err := json.Unmarshal(item, &request); err != nil {
+				responses[i] = newProblem(http.StatusBadRequest, problemMalformedRequest, "Invalid request envelope: "+err.Error()).Response()
+				responses[i].ID = recoverRequestID(item)
+				continue
+			}
+			if request.Ordered {
+				wg.Wait()
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() {
+					if r := recover(); r != nil {
+						responses[i] = panicResponse(r)
+					}
+					responses[i].ID = request.ID
+				}()
+				responses[i] = rc.serveBatchItem(request)
+			}()
+		}
+		wg.Wait()
+		if rc.ctx.Err() != nil {
+			return // Nobody left to answer
+		}
+		rc.sendBatch(responses)
+	}()
+}
+
+// serveBatchItem answers one request of a batch. Everything a lone request
+// may do is allowed, except for control messages, binary bodies and
+// streamed responses.
+func (rc *restChannel) serveBatchItem(request RestAPIMessage) RestAPIResponse {
+	if wait, ok := rc.allow(request); !ok {
+		return rateLimitedResponse(wait)
+	}
+	switch request.Method {
+	case methodHello, methodCancel, methodSubscribe, methodUnsubscribe:
+		return errorResponse(http.StatusBadRequest, request.Method+" cannot be sent in a batch")
+	}
+	if !requestMethods[strings.ToUpper(request.Method)] {
+		response := newProblem(http.StatusNotImplemented, problemUnknownMethod, "Unknown method "+request.Method).Response()
+		response.Headers.Set("Allow", allowedMethods())
+		return response
+	}
+	if request.Binary {
+		return errorResponse(http.StatusBadRequest, "Binary request bodies cannot be sent in a batch")
+	}
+	if request.Timeout < 0 {
+		return errorResponse(http.StatusBadRequest, "timeout must be a positive number of milliseconds")
+	}
+	fillRequestHeaders(&request)
+
+	reqCtx, cancel, ok := rc.track(request.ID)
+	if !ok {
+		return errorResponse(http.StatusConflict, "A request with this id is already in flight")
+	}
+	defer rc.untrack(request.ID, cancel)
+
+	ctx, cancelTimeout := withRequestTimeout(reqCtx, request)
+	defer cancelTimeout()
+
+	response, _ := rc.run(ctx, request)
+	if response.Streamer != nil {
+		return errorResponse(http.StatusNotImplemented, "Streaming responses cannot be sent in a batch")
+	}
+	return response
+}
+
+// sendBatch sends the responses of a batch as one message.
+func (rc *restChannel) sendBatch(responses []RestAPIResponse) {
+	for i := range responses {
+		embedBody(&responses[i])
+	}
+	err := rc.sendMessage(responses)
+	if errors.Is(err, errMessageTooLarge) {
+		log.Printf("Batch response too large: %v", err)
+		for i := range responses {
+			tooLarge := newProblem(http.StatusInternalServerError, problemTooLarge, "Batch response exceeds maximum message size").Response()
+			tooLarge.ID = responses[i].ID
+			embedBody(&tooLarge)
+			responses[i] = tooLarge
+		}
+		err = rc.sendMessage(responses)
+	}
+	if err != nil {
+		log.Printf("Failed to send batch response: %v", err)
+	}
+}
+
+// embedBody fills in the standard headers of a batched response and moves a
+// binary body into Body, where it is encoded as base64.
+func embedBody(response *RestAPIResponse) {
+	fillResponseHeaders(response)
+	if response.RawBody != nil {
+		response.Body = response.RawBody
+		response.RawBody = nil
+		response.Headers.Set("Content-Transfer-Encoding", "base64")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// batchHandler serves the endpoints the batch tests call. /slow takes a
+// while; /finished reports how many /slow requests have finished so far.
+func batchHandler(finished *atomic.Int32) Handler {
+	return func(req *Request) RestAPIResponse {
+		switch req.Endpoint {
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+			finished.Add(1)
+			return jsonResponse(http.StatusOK, "slow")
+		case "/fast":
+			return jsonResponse(http.StatusOK, "fast")
+		case "/finished":
+			return jsonResponse(http.StatusOK, finished.Load())
+		}
+		return errorResponse(http.StatusNotFound, "Not found")
+	}
+}
+
+func TestBatchOrder(t *testing.T) {
+	var finished atomic.Int32
+	defer func(h Handler) { restHandler = h }(restHandler)
+	restHandler = batchHandler(&finished)
+
+	dcA, dcB, _, _ := newPair(t, "batch", nil)
+	rc := newRestChannel(context.Background(), dcB)
+	defer rc.close()
+	replies := make(chan []byte, 4)
+	dcA.OnMessage(func(msg webrtc.DataChannelMessage) { replies <- msg.Data })
+
+	tests := []struct {
+		name       string
+		batch      string
+		wantIDs    []string
+		wantStatus []int
+		wantBodies []interface{} // nil entries are not checked
+	}{
+		{
+			name:       "responses keep request order",
+			batch:      `[{"id":"a","endpoint":"/slow"},{"id":"b","endpoint":"/fast"},{"id":"c","endpoint":"/missing"}]`,
+			wantIDs:    []string{"a", "b", "c"},
+			wantStatus: []int{200, 200, 404},
+			wantBodies: []interface{}{"slow", "fast", nil},
+		},
+		{
+			name:       "unordered request does not wait",
+			batch:      `[{"id":"a","endpoint":"/slow"},{"id":"b","endpoint":"/slow"},{"id":"c","endpoint":"/finished"}]`,
+			wantIDs:    []string{"a", "b", "c"},
+			wantStatus: []int{200, 200, 200},
+			wantBodies: []interface{}{"slow", "slow", float64(0)},
+		},
+		{
+			name:       "ordered request waits for those before it",
+			batch:      `[{"id":"a","endpoint":"/slow"},{"id":"b","endpoint":"/slow"},{"id":"c","endpoint":"/finished","ordered":true}]`,
+			wantIDs:    []string{"a", "b", "c"},
+			wantStatus: []int{200, 200, 200},
+			wantBodies: []interface{}{"slow", "slow", float64(2)},
+		},
+		{
+			name:       "bad items fail on their own",
+			batch:      `[{"id":"a","endpoint":"/fast"},{"id":"b","method":"HELLO"},{"id":"c","method":"BREW","endpoint":"/fast"},{"id":"d","method":7}]`,
+			wantIDs:    []string{"a", "b", "c", "d"},
+			wantStatus: []int{200, 400, 501, 400},
+			wantBodies: []interface{}{"fast", nil, nil, nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			finished.Store(0)
+			if err := dcA.SendText(tt.batch); err != nil {
+				t.Fatal(err)
+			}
+			var data []byte
+			select {
+			case data = <-replies:
+			case <-time.After(5 * time.Second):
+				t.Fatal("batch never answered")
+			}
+
+			var responses []struct {
+				ID     string      `json:"id"`
+				Status int         `json:"status"`
+				Body   interface{} `json:"body"`
+			}
+			if err := json.Unmarshal(data, &responses); err != nil {
+				t.Fatalf("reply %s: %v", data, err)
+			}
+			var ids []string
+			var statuses []int
+			for _, response := range responses {
+				ids = append(ids, response.ID)
+				statuses = append(statuses, response.Status)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) || !reflect.DeepEqual(statuses, tt.wantStatus) {
+				t.Fatalf("ids %v statuses %v, want %v %v", ids, statuses, tt.wantIDs, tt.wantStatus)
+			}
+			for i, want := range tt.wantBodies {
+				if want != nil && !reflect.DeepEqual(responses[i].Body, want) {
+					t.Errorf("response %s body = %v, want %v", responses[i].ID, responses[i].Body, want)
+				}
+			}
+		})
+	}
+}
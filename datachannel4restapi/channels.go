@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// channelService serves one data channel. close releases what it holds; it
+// is called once, when the channel or the whole session closes.
+type channelService interface {
+	close()
+}
+
+// queuedService is a channelService that sends through a send queue.
+type queuedService interface {
+	sendStats() sendQueueStats
+}
+
+// ChannelHandler starts serving a data channel the client opened.
+type ChannelHandler func(client *Client, dc *webrtc.DataChannel) channelService
+
+// ChannelRegistry picks the handler for each data channel the client opens,
+// by protocol or by label.
+type ChannelRegistry struct {
+	mu        sync.RWMutex
+	labels    map[string]channelRoute
+	protocols map[string]channelRoute
+}
+
+// channelRoute is a registered handler. Only unreliable routes accept
+// channels that may lose or reorder messages.
+type channelRoute struct {
+	handler    ChannelHandler
+	unreliable bool
+}
+
+func NewChannelRegistry() *ChannelRegistry {
+	return &ChannelRegistry{
+		labels:    make(map[string]channelRoute),
+		protocols: make(map[string]channelRoute),
+	}
+}
+
+// Handle serves reliable, ordered channels labelled label with h. Labels
+// with a "+suffix", such as "rest-api+cbor", are served by the handler for
+// the part before the "+".
+func (r *ChannelRegistry) Handle(label string, h ChannelHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.labels[label] = channelRoute{handler: h}
+}
+
+// HandleUnreliable is like Handle, but h also gets channels opened with
+// ordered false, maxRetransmits or maxPacketLifeTime. Such a handler must
+// treat every message on its own: any of them may be lost or arrive late.
+func (r *ChannelRegistry) HandleUnreliable(label string, h ChannelHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.labels[label] = channelRoute{handler: h, unreliable: true}
+}
+
+// HandleProtocol serves reliable, ordered channels opened with protocol
+// with h, whatever their label.
+func (r *ChannelRegistry) HandleProtocol(protocol string, h ChannelHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.protocols[protocol] = channelRoute{handler: h}
+}
+
+// lookup finds the route for a channel: a protocol match wins over an
+// exact label, which wins over the label's "+suffix" base.
+func (r *ChannelRegistry) lookup(label, protocol string) (channelRoute, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if route, ok := r.protocols[protocol]; ok && protocol != "" {
+		return route, true
+	}
+	if route, ok := r.labels[label]; ok {
+		return route, true
+	}
+	if base, _, ok := strings.Cut(label, "+"); ok {
+		route, ok := r.labels[base]
+		return route, ok
+	}
+	return channelRoute{}, false
+}
+
+// isReliable reports whether dc delivers every message, in order.
+func isReliable(dc *webrtc.DataChannel) bool {
+	return dc.Ordered() && dc.MaxRetransmits() == nil && dc.MaxPacketLifeTime() == nil
+}
+
+// serveDataChannel hands dc to its registered handler and tracks it on the
+// session until it closes. Channels nobody handles, and unreliable ones
+// whose handler needs every message, are closed.
+func (c *Client) serveDataChannel(dc *webrtc.DataChannel) {
+	route, ok := dataChannels.lookup(dc.Label(), dc.Protocol())
+	if !ok {
+		log.Printf("No handler for data channel %q (protocol %q), closing it", dc.Label(), dc.Protocol())
+		dc.Close()
+		return
+	}
+	if !route.unreliable && !isReliable(dc) {
+		log.Printf("Data channel %q must be reliable and ordered, closing it", dc.Label())
+		dc.Close()
+		return
+	}
+	c.trackChannel(dc, route.handler(c, dc))
+}
+
+// trackChannel records that service serves dc, until dc closes.
+func (c *Client) trackChannel(dc *webrtc.DataChannel, service channelService) {
+	c.mu.Lock()
+	c.channels[dc] = service
+	c.mu.Unlock()
+
+	dc.OnClose(func() {
+		log.Printf("❌ Data channel %s closed on server side", dc.Label())
+		c.closeChannel(dc)
+	})
+	dc.OnError(func(err error) {
+		log.Printf("⚠️ Data channel %s error on server side: %v", dc.Label(), err)
+	})
+}
+
+// closeChannel stops serving dc, if it is still being served.
+func (c *Client) closeChannel(dc *webrtc.DataChannel) {
+	c.mu.Lock()
+	service, ok := c.channels[dc]
+	delete(c.channels, dc)
+	c.mu.Unlock()
+	if ok {
+		service.close()
+	}
+}
+
+// closeChannels stops serving every channel of the session.
+func (c *Client) closeChannels() {
+	c.mu.Lock()
+	open := make([]*webrtc.DataChannel, 0, len(c.channels))
+	for dc := range c.channels {
+		open = append(open, dc)
+	}
+	c.mu.Unlock()
+	for _, dc := range open {
+		c.closeChannel(dc)
+	}
+}
+
+// sendStats adds up the send queues of the session's channels.
+func (c *Client) sendStats() sendQueueStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var total sendQueueStats
+	for _, service := range c.channels {
+		if queued, ok := service.(queuedService); ok {
+			total = total.add(queued.sendStats())
+		}
+	}
+	return total
+}
+
+// closeSession ends the session, closing its peer connection and signaling
+// socket. Everything still running is cancelled as a result.
+func (c *Client) closeSession(reason string) {
+	log.Printf("🚫 Closing session %s: %s", c.id, reason)
+	if c.peerConn != nil {
+		c.peerConn.Close()
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// channelCount returns how many data channels the session is serving.
+func (c *Client) channelCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.channels)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// chatLabel is the data channel label for the chat room every session
+// shares.
+const chatLabel = "chat"
+
+// maxChatMessage bounds the text of a single chat message, in bytes.
+const maxChatMessage = 4096
+
+// ChatMessage is relayed to every chat channel. Event is "joined", "left"
+// or "message"; From is the sender's session id.
+type ChatMessage struct {
+	Event string    `json:"event"`
+	From  string    `json:"from"`
+	Text  string    `json:"text,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// chatRoom relays messages between its members.
+type chatRoom struct {
+	mu      sync.RWMutex
+	members map[*chatChannel]struct{}
+}
+
+// lobby is the room every chat channel joins.
+var lobby = &chatRoom{members: make(map[*chatChannel]struct{})}
+
+func (r *chatRoom) join(cc *chatChannel) {
+	r.mu.Lock()
+	r.members[cc] = struct{}{}
+	r.mu.Unlock()
+	r.broadcast(ChatMessage{Event: "joined", From: cc.from})
+}
+
+func (r *chatRoom) leave(cc *chatChannel) {
+	r.mu.Lock()
+	_, ok := r.members[cc]
+	delete(r.members, cc)
+	r.mu.Unlock()
+	if ok {
+		r.broadcast(ChatMessage{Event: "left", From: cc.from})
+	}
+}
+
+// broadcast sends msg to every member. Members too far behind miss it,
+// rather than hold up the rest of the room.
+func (r *chatRoom) broadcast(msg ChatMessage) {
+	msg.Time = time.Now().UTC()
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode chat message: %v", err)
+		return
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for member := range r.members {
+		if !member.out.trySend(data, true) {
+			log.Printf("Chat message to %s dropped, its channel is backed up", member.from)
+		}
+	}
+}
+
+// chatChannel is one session's membership of a chat room.
+type chatChannel struct {
+	room *chatRoom
+	out  *sendQueue
+	from string
+}
+
+// serveChatChannel joins dc to the lobby once it opens. Each text message
+// the client sends, either plain text or {"text": "..."}, is relayed to
+// every member.
+func serveChatChannel(client *Client, dc *webrtc.DataChannel) channelService {
+	cc := &chatChannel{room: lobby, out: newSendQueue(dc), from: client.id}
+	dc.OnOpen(func() {
+		cc.room.join(cc)
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if !msg.IsString {
+			return
+		}
+		text := string(msg.Data)
+		var envelope struct {
+			Text string `json:"text"`
+		}
+		if strings.HasPrefix(text, "{") && json.Unmarshal(msg.Data, &envelope) == nil {
+			text = envelope.Text
+		}
+		text = strings.TrimSpace(text)
+		if text == "" || len(text) > maxChatMessage {
+			return
+		}
+		cc.room.broadcast(ChatMessage{Event: "message", From: cc.from, Text: text})
+	})
+	return cc
+}
+
+func (cc *chatChannel) sendStats() sendQueueStats {
+	return cc.out.stats()
+}
+
+func (cc *chatChannel) close() {
+	cc.room.leave(cc)
+	cc.out.close()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Compressed bodies travel as binary bodies (see restchannel.go) with a
+// Content-Encoding header, so the envelope itself stays readable. Only the
+// encodings browsers can undo with DecompressionStream are offered, in order
+// of preference. "deflate" is the zlib format, as in HTTP.
+var supportedEncodings = []string{"gzip", "deflate"}
+
+// compressThreshold is the smallest body, in bytes, worth compressing.
+var compressThreshold = 1024
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// acceptEncodingHeader advertises the encodings the server accepts for
+// request bodies.
+func acceptEncodingHeader() string {
+	return strings.Join(supportedEncodings, ", ")
+}
+
+// negotiateEncoding picks the preferred supported encoding allowed by an
+// Accept-Encoding header, or "" if the body should be sent as-is.
+func negotiateEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := map[string]bool{}
+	wildcard := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if name == "*" {
+			wildcard = q > 0
+			continue
+		}
+		accepted[name] = q > 0
+	}
+
+	for _, encoding := range supportedEncodings {
+		if ok, listed := accepted[encoding]; ok || !listed && wildcard {
+			return encoding
+		}
+	}
+	return ""
+}
+
+func compressBytes(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedEncoding, encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressBytes undoes encoding, refusing to inflate beyond limit bytes.
+func decompressBytes(encoding string, data []byte, limit int) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	case "identity":
+		return data, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedEncoding, encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, errMessageTooLarge
+	}
+	return out, nil
+}
+
+// compressResponse compresses response's body when the request accepts a
+// supported encoding and the body is large enough to benefit. The compressed
+// body replaces Body with RawBody and is sent in binary body frames.
+func compressResponse(request RestAPIMessage, response RestAPIResponse) RestAPIResponse {
+	encoding := negotiateEncoding(request.Headers.Get("Accept-Encoding"))
+	if encoding == "" || response.Streamer != nil || response.Headers.Get("Content-Encoding") != "" {
+		return response
+	}
+
+	data := response.RawBody
+	if data == nil {
+		switch body := response.Body.(type) {
+		case nil:
+			return response
+		case string:
+			// Text keeps its Content-Type, so it is not sent as a JSON string
+			data = []byte(body)
+		default:
+			var err error
+			if data, err = json.Marshal(body); err != nil {
+				return response
+			}
+		}
+	}
+	if len(data) < compressThreshold || !isCompressible(response.Headers.Get("Content-Type")) {
+		return response
+	}
+
+	compressed, err := compressBytes(encoding, data)
+	if err != nil || len(compressed) >= len(data) {
+		return response
+	}
+	log.Printf("Compressed response %s with %s: %d -> %d bytes", request.ID, encoding, len(data), len(compressed))
+
+	headers := response.Headers.Clone()
+	if headers.Get("Content-Type") == "" {
+		headers.Set("Content-Type", responseContentType(response))
+	}
+	headers.Set("Content-Encoding", encoding)
+	headers.Add("Vary", "Accept-Encoding")
+	response.Headers = headers
+	response.Body = nil
+	response.RawBody = compressed
+	return response
+}
+
+// decompressRequest decodes a binary request body sent with a
+// Content-Encoding. JSON bodies become the request's Body again, so handlers
+// never see the difference.
+func decompressRequest(request *RestAPIMessage) *RestAPIResponse {
+	encoding := request.Headers.Get("Content-Encoding")
+	if encoding == "" || request.RawBody == nil {
+		return nil
+	}
+
+	data, err := decompressBytes(encoding, request.RawBody, maxMessageSize)
+	if err != nil {
+		var resp RestAPIResponse
+		switch {
+		case errors.Is(err, errUnsupportedEncoding):
+			resp = errorResponse(http.StatusUnsupportedMediaType, err.Error())
+			resp.Headers.Set("Accept-Encoding", acceptEncodingHeader())
+		case errors.Is(err, errMessageTooLarge):
+			resp = newProblem(http.StatusRequestEntityTooLarge, problemTooLarge, "Decompressed body exceeds maximum message size").Response()
+		default:
+			resp = errorResponse(http.StatusBadRequest, "Invalid compressed body: "+err.Error())
+		}
+		return &resp
+	}
+
+	headers := request.Headers.Clone()
+	headers.Del("Content-Encoding")
+	request.Headers = headers
+	request.RawBody = data
+
+	contentType := headers.Get("Content-Type")
+	if isBinaryContentType(contentType) {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		var body interface{}
+		if err := json.Unmarshal(data, &body); err != nil {
+			resp := errorResponse(http.StatusBadRequest, "Invalid JSON body")
+			return &resp
+		}
+		request.Body = body
+	} else {
+		request.Body = string(data)
+	}
+	request.RawBody = nil
+	request.Binary = false
+	return nil
+}
+
+// isCompressible reports whether content of this type is likely to shrink.
+// Images, audio, video and archives are usually compressed already.
+func isCompressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml",
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "video/"),
+		mediaType == "application/zip",
+		mediaType == "application/gzip",
+		mediaType == "application/zstd":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompressResponse(t *testing.T) {
+	text := strings.Repeat("hello world ", 200)
+	tests := []struct {
+		name            string
+		acceptEncoding  string
+		response        RestAPIResponse
+		wantEncoding    string
+		wantBody        string
+		wantContentType string
+	}{
+		{
+			name:            "text stays text",
+			acceptEncoding:  "gzip",
+			response:        RestAPIResponse{Status: http.StatusOK, Headers: Header{"Content-Type": {"text/html"}}, Body: text},
+			wantEncoding:    "gzip",
+			wantBody:        text,
+			wantContentType: "text/html",
+		},
+		{
+			name:            "text without a type",
+			acceptEncoding:  "deflate",
+			response:        RestAPIResponse{Status: http.StatusOK, Body: text},
+			wantEncoding:    "deflate",
+			wantBody:        text,
+			wantContentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:            "JSON",
+			acceptEncoding:  "gzip",
+			response:        RestAPIResponse{Status: http.StatusOK, Body: []string{text}},
+			wantEncoding:    "gzip",
+			wantBody:        `["` + text + `"]`,
+			wantContentType: "application/json",
+		},
+		{
+			name:           "small body",
+			acceptEncoding: "gzip",
+			response:       RestAPIResponse{Status: http.StatusOK, Body: "hello"},
+		},
+		{
+			name:     "not accepted",
+			response: RestAPIResponse{Status: http.StatusOK, Body: text},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := RestAPIMessage{ID: "1", Headers: Header{"Accept-Encoding": {tt.acceptEncoding}}}
+			response := compressResponse(request, tt.response)
+			encoding := response.Headers.Get("Content-Encoding")
+			if encoding != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", encoding, tt.wantEncoding)
+			}
+			if encoding == "" {
+				if response.RawBody != nil {
+					t.Fatal("uncompressed response has a raw body")
+				}
+				return
+			}
+			if got := response.Headers.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			data, err := decompressBytes(encoding, response.RawBody, maxMessageSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantBody {
+				t.Fatalf("decompressed body starts %.20q, want %.20q", data, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pion/webrtc/v4"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Envelopes are JSON unless the client picks a compact binary encoding for
+// its channel. It can do so when opening the channel, by setting the data
+// channel protocol to "msgpack" or "cbor" or by labelling it e.g.
+// "rest-api+cbor". It can also switch with a HELLO handshake as its very
+// first message:
+//
+//	{"id": "hello", "method": "HELLO", "body": {"encoding": "msgpack"}}
+//
+// The HELLO answer still uses the old encoding; everything after it uses the
+// new one. Binary envelopes are sent as binary messages:
+//
+//	type(1) | encoded envelope
+//
+// The encoding only changes the bytes on the wire. Envelopes have the same
+// fields and body values as their JSON form, so handlers cannot tell.
+const frameEnvelope byte = 0x03
+
+const methodHello = "HELLO"
+
+// binaryCodec encodes and decodes envelopes in one binary encoding. JSON
+// needs none.
+type binaryCodec struct {
+	name      string
+	marshal   func(v interface{}) ([]byte, error)
+	unmarshal func(data []byte, v interface{}) error
+	// startsArray tells from its first byte whether a value is an array
+	startsArray func(b byte) bool
+}
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+var binaryCodecs = map[string]*binaryCodec{
+	"msgpack": {name: "msgpack", marshal: msgpack.Marshal, unmarshal: msgpack.Unmarshal, startsArray: msgpackArray},
+	"cbor":    {name: "cbor", marshal: cbor.Marshal, unmarshal: cborDecMode.Unmarshal, startsArray: cborArray},
+}
+
+// msgpackArray matches the fixarray, array 16 and array 32 formats.
+func msgpackArray(b byte) bool {
+	return b&0xf0 == 0x90 || b == 0xdc || b == 0xdd
+}
+
+// cborArray matches major type 4.
+func cborArray(b byte) bool {
+	return b>>5 == 4
+}
+
+var errNoEncoding = errors.New("binary envelope received before an encoding was negotiated")
+
+// lookupCodec returns the codec called name, nil for JSON, or false if the
+// encoding is not supported.
+func lookupCodec(name string) (*binaryCodec, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "json" {
+		return nil, true
+	}
+	codec, ok := binaryCodecs[name]
+	return codec, ok
+}
+
+// supportedCodecs lists the encodings a client can ask for.
+func supportedCodecs() []string {
+	names := []string{"json"}
+	for name := range binaryCodecs {
+		names = append(names, name)
+	}
+	slices.Sort(names[1:])
+	return names
+}
+
+// channelCodec picks the encoding dc was opened with: its protocol, or else
+// the suffix after "+" in its label. Channels that name neither use JSON.
+func channelCodec(dc *webrtc.DataChannel) *binaryCodec {
+	name := dc.Protocol()
+	if name == "" {
+		if _, suffix, ok := strings.Cut(dc.Label(), "+"); ok {
+			name = suffix
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	codec, ok := lookupCodec(name)
+	if !ok {
+		log.Printf("Unsupported encoding %q on data channel %s, using JSON", name, dc.Label())
+	}
+	return codec
+}
+
+// encode turns an envelope into a binary message. The envelope goes through
+// JSON first so that struct tags, omitempty, custom marshalers and raw JSON
+// bodies come out exactly as they would in a JSON envelope.
+func (c *binaryCodec) encode(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	encoded, err := c.marshal(fromJSONNumbers(generic))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{frameEnvelope}, encoded...), nil
+}
+
+// decode reads a binary envelope frame into v, by way of its JSON form.
+func (c *binaryCodec) decode(frame []byte, v interface{}) error {
+	var generic interface{}
+	if err := c.unmarshal(frame[1:], &generic); err != nil {
+		return err
+	}
+	data, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// fromJSONNumbers replaces json.Numbers with int64 or float64 so binary
+// encodings keep integers as integers.
+func fromJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = fromJSONNumbers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = fromJSONNumbers(value)
+		}
+	}
+	return v
+}
+
+// decodeRequest parses a request envelope in whichever encoding it arrived.
+// JSON text is always understood, so a HELLO can be sent before switching.
+func (rc *restChannel) decodeRequest(msg webrtc.DataChannelMessage) (RestAPIMessage, error) {
+	var request RestAPIMessage
+	if msg.IsString || len(msg.Data) == 0 || msg.Data[0] != frameEnvelope {
+		err := json.Unmarshal(msg.Data, &request)
+		return request, err
+	}
+	codec := rc.codec.Load()
+	if codec == nil {
+		return request, errNoEncoding
+	}
+	err := codec.decode(msg.Data, &request)
+	return request, err
+}
+
+// recoverRequestID finds the ID of a request envelope that could not be
+// decoded, or returns "".
+func (rc *restChannel) recoverRequestID(msg webrtc.DataChannelMessage) string {
+	if msg.IsString || len(msg.Data) == 0 || msg.Data[0] != frameEnvelope {
+		return recoverRequestID(msg.Data)
+	}
+	codec := rc.codec.Load()
+	if codec == nil {
+		return ""
+	}
+	var generic interface{}
+	codec.unmarshal(msg.Data[1:], &generic)
+	members, _ := generic.(map[string]interface{})
+	id, _ := members["id"].(string)
+	return id
+}
+
+// handleHello switches the channel to the encoding named in request's body.
+// It is only accepted as the first message on the channel.
+func (rc *restChannel) handleHello(request RestAPIMessage, first bool) {
+	if !first {
+		rc.reply(request.ID, errorResponse(http.StatusConflict, "HELLO must be the first message on the channel"))
+		return
+	}
+	body, _ := request.Body.(map[string]interface{})
+	name, _ := body["encoding"].(string)
+	codec, ok := lookupCodec(name)
+	if !ok {
+		rc.reply(request.ID, newProblem(http.StatusBadRequest, "", "Unsupported encoding "+name).With("encodings", supportedCodecs()).Response())
+		return
+	}
+
+	name = "json"
+	if codec != nil {
+		name = codec.name
+	}
+	rc.reply(request.ID, jsonResponse(http.StatusOK, map[string]string{"encoding": name}))
+	rc.codec.Store(codec)
+	log.Printf("🔤 Data channel switched to %s envelopes", name)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// fileTransferLabel is the data channel label clients upload files on.
+//
+// An upload starts with a text message holding a FileHeader. The file's
+// bytes follow as binary messages, and once size bytes have arrived the
+// server answers with a FileStatus carrying their SHA-256. A new header
+// abandons any upload still in progress.
+const fileTransferLabel = "file-transfer"
+
+// uploadDir receives uploaded files, each prefixed with the uploading
+// session's id.
+var uploadDir = filepath.Join(os.TempDir(), "webrtc-uploads")
+
+// maxUploadSize is the largest file accepted, in bytes.
+var maxUploadSize int64 = 100 << 20
+
+// FileHeader announces an upload.
+type FileHeader struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Type string `json:"type,omitempty"`
+}
+
+// FileStatus reports on an upload: "accepted" after its header, then
+// "complete" or "error".
+type FileStatus struct {
+	Status   string `json:"status"`
+	Name     string `json:"name,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Received int64  `json:"received,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// upload is a file being received.
+type upload struct {
+	header   FileHeader
+	file     *os.File
+	hash     hash.Hash
+	received int64
+}
+
+// fileTransferChannel receives one upload at a time from a session.
+type fileTransferChannel struct {
+	dc   *webrtc.DataChannel
+	out  *sendQueue
+	from string
+
+	mu      sync.Mutex
+	current *upload
+}
+
+func serveFileTransferChannel(client *Client, dc *webrtc.DataChannel) channelService {
+	fc := &fileTransferChannel{dc: dc, out: newSendQueue(dc), from: client.id}
+	dc.OnMessage(fc.handleMessage)
+	return fc
+}
+
+func (fc *fileTransferChannel) handleMessage(msg webrtc.DataChannelMessage) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if msg.IsString {
+		var header FileHeader
+		if err := json.Unmarshal(msg.Data, &header); err != nil {
+			fc.reply(FileStatus{Status: "error", Error: "invalid file header: " + err.Error()})
+			return
+		}
+		fc.start(header)
+		return
+	}
+
+	up := fc.current
+	if up == nil {
+		fc.reply(FileStatus{Status: "error", Error: "file data without a header"})
+		return
+	}
+	if up.received+int64(len(msg.Data)) > up.header.Size {
+		fc.fail(fmt.Errorf("received more than the announced %d bytes", up.header.Size))
+		return
+	}
+	if _, err := up.file.Write(msg.Data); err != nil {
+		fc.fail(err)
+		return
+	}
+	up.hash.Write(msg.Data)
+	up.received += int64(len(msg.Data))
+	if up.received == up.header.Size {
+		fc.finish()
+	}
+}
+
+// start begins receiving the file header announces. fc.mu must be held.
+func (fc *fileTransferChannel) start(header FileHeader) {
+	if fc.current != nil {
+		fc.fail(errors.New("abandoned for a new upload"))
+	}
+
+	name := filepath.Base(header.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		fc.reply(FileStatus{Status: "error", Name: header.Name, Error: "invalid file name"})
+		return
+	}
+	header.Name = name
+	if header.Size < 0 || header.Size > maxUploadSize {
+		fc.reply(FileStatus{Status: "error", Name: name, Error: fmt.Sprintf("size must be between 0 and %d bytes", maxUploadSize)})
+		return
+	}
+
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		log.Printf("Failed to create upload directory: %v", err)
+		fc.reply(FileStatus{Status: "error", Name: name, Error: "uploads are unavailable"})
+		return
+	}
+	file, err := os.CreateTemp(uploadDir, ".upload-*")
+	if err != nil {
+		log.Printf("Failed to create upload file: %v", err)
+		fc.reply(FileStatus{Status: "error", Name: name, Error: "uploads are unavailable"})
+		return
+	}
+	fc.current = &upload{header: header, file: file, hash: sha256.New()}
+	log.Printf("📁 Receiving %s (%d bytes) from %s", name, header.Size, fc.from)
+	fc.reply(FileStatus{Status: "accepted", Name: name, Size: header.Size})
+	if header.Size == 0 {
+		fc.finish()
+	}
+}
+
+// finish stores the completed upload under its final name. fc.mu must be
+// held.
+func (fc *fileTransferChannel) finish() {
+	up := fc.current
+	fc.current = nil
+	path := filepath.Join(uploadDir, fc.from+"-"+up.header.Name)
+	if err := up.file.Close(); err != nil {
+		os.Remove(up.file.Name())
+		fc.reply(FileStatus{Status: "error", Name: up.header.Name, Error: err.Error()})
+		return
+	}
+	if err := os.Rename(up.file.Name(), path); err != nil {
+		os.Remove(up.file.Name())
+		log.Printf("Failed to store upload: %v", err)
+		fc.reply(FileStatus{Status: "error", Name: up.header.Name, Error: "the file could not be stored"})
+		return
+	}
+	log.Printf("📁 Stored %s", path)
+	fc.reply(FileStatus{
+		Status:   "complete",
+		Name:     up.header.Name,
+		Size:     up.header.Size,
+		Received: up.received,
+		SHA256:   hex.EncodeToString(up.hash.Sum(nil)),
+	})
+}
+
+// fail discards the current upload and reports err. fc.mu must be held.
+func (fc *fileTransferChannel) fail(err error) {
+	up := fc.current
+	fc.current = nil
+	up.file.Close()
+	os.Remove(up.file.Name())
+	fc.reply(FileStatus{Status: "error", Name: up.header.Name, Received: up.received, Error: err.Error()})
+}
+
+func (fc *fileTransferChannel) reply(status FileStatus) {
+	if fc.dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("Failed to encode upload status: %v", err)
+		return
+	}
+	if err := fc.out.send(data, true); err != nil {
+		log.Printf("Failed to send upload status: %v", err)
+	}
+}
+
+func (fc *fileTransferChannel) sendStats() sendQueueStats {
+	return fc.out.stats()
+}
+
+// close discards an upload the client did not finish.
+func (fc *fileTransferChannel) close() {
+	// Closed first to release a reply waiting for room with fc.mu held
+	fc.out.close()
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if up := fc.current; up != nil {
+		fc.current = nil
+		up.file.Close()
+		os.Remove(up.file.Name())
+		log.Printf("Discarded unfinished upload %s (%d of %d bytes)", up.header.Name, up.received, up.header.Size)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Messages larger than fragmentSize are split into fragment frames. 16 KiB is
+// the largest message size every browser accepts without negotiation.
+const fragmentSize = 16 * 1024
+
+// reassemblyTimeout bounds how long a partially received message is kept.
+var reassemblyTimeout = 30 * time.Second
+
+// maxPartialMessages bounds how many messages a peer may have partially sent
+// on one channel at a time. Fragments starting further messages are refused.
+const maxPartialMessages = 16
+
+// Binary data channel messages start with a frame type byte. Text messages
+// and binary messages starting with '{' or '[' are whole JSON envelopes.
+const (
+	frameFragment byte = 0x01
+)
+
+// Fragment frame layout (big endian):
+//
+//	type(1) | kind(1) | message id(4) | sequence(4) | total length(4) | payload
+//
+// kind tells whether the reassembled payload is a text or binary message.
+const fragmentHeaderSize = 14
+
+const (
+	fragmentKindText   byte = 0
+	fragmentKindBinary byte = 1
+)
+
+var (
+	errFragmentMissing   = errors.New("fragment missing or out of order")
+	errMessageTooLarge   = errors.New("message exceeds maximum size")
+	errReassemblyTimeout = errors.New("timed out waiting for remaining fragments")
+	errMalformedFragment = errors.New("malformed fragment frame")
+	errTooManyPartials   = fmt.Errorf("more than %d fragmented messages in progress", maxPartialMessages)
+)
+
+// maxMessageSize caps the total size of a reassembled or outgoing message.
+var maxMessageSize = 16 << 20
+
+// partialMessage collects the fragments of one message.
+type partialMessage struct {
+	kind  byte
+	total int
+	next  uint32
+	data  []byte
+	timer *time.Timer
+}
+
+// framedChannel adds fragmentation and reassembly on top of a data channel so
+// that messages larger than one SCTP message can be exchanged. Everything it
+// sends goes through out, so its send methods block while the channel is
+// backed up.
+type framedChannel struct {
+	dc      *webrtc.DataChannel
+	out     *sendQueue
+	maxSize int
+	nextID  atomic.Uint32
+
+	mu       sync.Mutex
+	partials map[uint32]*partialMessage
+	onError  func(id uint32, err error)
+}
+
+func newFramedChannel(dc *webrtc.DataChannel, maxSize int) *framedChannel {
+	return &framedChannel{
+		dc:       dc,
+		out:      newSendQueue(dc),
+		maxSize:  maxSize,
+		partials: make(map[uint32]*partialMessage),
+	}
+}
+
+// OnMessage sets the handler called with every complete message, whether it
+// arrived in one piece or was reassembled from fragments.
+func (c *framedChannel) OnMessage(f func(msg webrtc.DataChannelMessage)) {
+	c.dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if msg.IsString || len(msg.Data) == 0 || msg.Data[0] != frameFragment {
+			f(msg)
+			return
+		}
+		if complete, ok := c.reassemble(msg.Data); ok {
+			f(complete)
+		}
+	})
+}
+
+// OnError sets the handler called when a fragmented message cannot be
+// reassembled. id is the sender's message id from the fragment header.
+func (c *framedChannel) OnError(f func(id uint32, err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onError = f
+}
+
+// SendText sends a text message, fragmenting it if necessary. It waits
+// while the send queue is full.
+func (c *framedChannel) SendText(data []byte) error {
+	if len(data) <= fragmentSize {
+		return c.out.send(data, true)
+	}
+	return c.sendFragments(fragmentKindText, data)
+}
+
+// Send sends a binary message, fragmenting it if necessary. It waits while
+// the send queue is full.
+func (c *framedChannel) Send(data []byte) error {
+	if len(data) <= fragmentSize && (len(data) == 0 || data[0] != frameFragment) {
+		return c.out.send(data, false)
+	}
+	return c.sendFragments(fragmentKindBinary, data)
+}
+
+func (c *framedChannel) sendFragments(kind byte, data []byte) error {
+	if len(data) > c.maxSize {
+		return fmt.Errorf("%w: %d > %d bytes", errMessageTooLarge, len(data), c.maxSize)
+	}
+
+	id := c.nextID.Add(1)
+	for seq, offset := uint32(0), 0; offset < len(data); seq++ {
+		end := min(offset+fragmentSize, len(data))
+
+		frame := make([]byte, fragmentHeaderSize+end-offset)
+		frame[0] = frameFragment
+		frame[1] = kind
+		binary.BigEndian.PutUint32(frame[2:], id)
+		binary.BigEndian.PutUint32(frame[6:], seq)
+		binary.BigEndian.PutUint32(frame[10:], uint32(len(data)))
+		copy(frame[fragmentHeaderSize:], data[offset:end])
+
+		if err := c.out.send(frame, false); err != nil {
+			return err
+		}
+		offset = end
+	}
+	return nil
+}
+
+// reassemble adds a fragment frame to its message and returns the message
+// once the last fragment has arrived.
+func (c *framedChannel) reassemble(frame []byte) (webrtc.DataChannelMessage, bool) {
+	if len(frame) < fragmentHeaderSize {
+		c.fail(0, errMalformedFragment)
+		return webrtc.DataChannelMessage{}, false
+	}
+	kind := frame[1]
+	id := binary.BigEndian.Uint32(frame[2:])
+	seq := binary.BigEndian.Uint32(frame[6:])
+	total := int(binary.BigEndian.Uint32(frame[10:]))
+	payload := frame[fragmentHeaderSize:]
+
+	c.mu.Lock()
+	partial, ok := c.partials[id]
+	if !ok {
+		if seq != 0 {
+			c.mu.Unlock()
+			c.fail(id, errFragmentMissing)
+			return webrtc.DataChannelMessage{}, false
+		}
+		if total > c.maxSize {
+			c.mu.Unlock()
+			c.fail(id, fmt.Errorf("%w: %d > %d bytes", errMessageTooLarge, total, c.maxSize))
+			return webrtc.DataChannelMessage{}, false
+		}
+		if len(c.partials) >= maxPartialMessages {
+			c.mu.Unlock()
+			c.fail(id, errTooManyPartials)
+			return webrtc.DataChannelMessage{}, false
+		}
+		// total is only the sender's claim, so the buffer grows with the
+		// fragments that actually arrive
+		partial = &partialMessage{kind: kind, total: total}
+		partial.timer = time.AfterFunc(reassemblyTimeout, func() {
+			if c.drop(id) {
+				c.fail(id, errReassemblyTimeout)
+			}
+		})
+		c.partials[id] = partial
+	}
+
+	if seq != partial.next || kind != partial.kind || total != partial.total || len(partial.data)+len(payload) > total {
+		partial.timer.Stop()
+		delete(c.partials, id)
+		c.mu.Unlock()
+		c.fail(id, errFragmentMissing)
+		return webrtc.DataChannelMessage{}, false
+	}
+	partial.data = append(partial.data, payload...)
+	partial.next++
+	if len(partial.data) < total {
+		partial.timer.Reset(reassemblyTimeout)
+		c.mu.Unlock()
+		return webrtc.DataChannelMessage{}, false
+	}
+
+	partial.timer.Stop()
+	delete(c.partials, id)
+	c.mu.Unlock()
+	return webrtc.DataChannelMessage{IsString: kind == fragmentKindText, Data: partial.data}, true
+}
+
+// drop discards a partial message, reporting whether it was still pending.
+func (c *framedChannel) drop(id uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.partials[id]; !ok {
+		return false
+	}
+	delete(c.partials, id)
+	return true
+}
+
+func (c *framedChannel) fail(id uint32, err error) {
+	log.Printf("Failed to reassemble message %d on %s: %v", id, c.dc.Label(), err)
+	c.mu.Lock()
+	onError := c.onError
+	c.mu.Unlock()
+	if onError != nil {
+		onError(id, err)
+	}
+}
+
+// stats describes the channel's send queue.
+func (c *framedChannel) stats() sendQueueStats {
+	return c.out.stats()
+}
+
+// close discards all partially received messages and anything still
+// waiting to be sent.
+func (c *framedChannel) close() {
+	c.out.close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, partial := range c.partials {
+		partial.timer.Stop()
+		delete(c.partials, id)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// fragmentFrame builds a fragment frame by hand.
+func fragmentFrame(kind byte, id, seq uint32, total int, payload []byte) []byte {
+	frame := make([]byte, fragmentHeaderSize, fragmentHeaderSize+len(payload))
+	frame[0] = frameFragment
+	frame[1] = kind
+	binary.BigEndian.PutUint32(frame[2:], id)
+	binary.BigEndian.PutUint32(frame[6:], seq)
+	binary.BigEndian.PutUint32(frame[10:], uint32(total))
+	return append(frame, payload...)
+}
+
+// fragmentFrames splits data into frames of at most size payload bytes.
+func fragmentFrames(kind byte, id uint32, data []byte, size int) [][]byte {
+	var frames [][]byte
+	for seq, offset := uint32(0), 0; offset < len(data); seq++ {
+		end := min(offset+size, len(data))
+		frames = append(frames, fragmentFrame(kind, id, seq, len(data), data[offset:end]))
+		offset = end
+	}
+	return frames
+}
+
+// reassembler is a framedChannel that only reassembles, recording what
+// comes out of it.
+type reassembler struct {
+	*framedChannel
+	messages []webrtc.DataChannelMessage
+	errs     chan error
+}
+
+func newReassembler(maxSize int) *reassembler {
+	r := &reassembler{
+		framedChannel: &framedChannel{
+			dc:       &webrtc.DataChannel{},
+			maxSize:  maxSize,
+			partials: make(map[uint32]*partialMessage),
+		},
+		errs: make(chan error, 64),
+	}
+	r.OnError(func(id uint32, err error) { r.errs <- err })
+	return r
+}
+
+func (r *reassembler) feed(frames ...[]byte) {
+	for _, frame := range frames {
+		if msg, ok := r.reassemble(frame); ok {
+			r.messages = append(r.messages, msg)
+		}
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	message := []byte("a message split into several fragments")
+	frames := fragmentFrames(fragmentKindText, 1, message, 8)
+	other := fragmentFrames(fragmentKindBinary, 2, []byte("another one"), 4)
+
+	tests := []struct {
+		name     string
+		frames   [][]byte
+		want     [][]byte
+		wantText bool
+		wantErr  error
+	}{
+		{
+			name:     "in order",
+			frames:   frames,
+			want:     [][]byte{message},
+			wantText: true,
+		},
+		{
+			name:   "single fragment",
+			frames: fragmentFrames(fragmentKindBinary, 1, []byte{1, 2, 3}, 8),
+			want:   [][]byte{{1, 2, 3}},
+		},
+		{
+			name:   "interleaved with another message",
+			frames: [][]byte{other[0], frames[0], other[1], frames[1], frames[2], other[2], frames[3], frames[4]},
+			want:   [][]byte{[]byte("another one"), message},
+		},
+		{
+			name:    "first fragment missing",
+			frames:  frames[1:],
+			wantErr: errFragmentMissing,
+		},
+		{
+			name:    "out of order",
+			frames:  [][]byte{frames[0], frames[2], frames[1], frames[3], frames[4]},
+			wantErr: errFragmentMissing,
+		},
+		{
+			name:    "kind changes",
+			frames:  [][]byte{frames[0], fragmentFrame(fragmentKindBinary, 1, 1, len(message), message[8:16])},
+			wantErr: errFragmentMissing,
+		},
+		{
+			name:    "longer than announced",
+			frames:  [][]byte{fragmentFrame(fragmentKindText, 1, 0, 4, []byte("too long"))},
+			wantErr: errFragmentMissing,
+		},
+		{
+			name:    "oversize",
+			frames:  [][]byte{fragmentFrame(fragmentKindText, 1, 0, 1<<20, []byte("x"))},
+			wantErr: errMessageTooLarge,
+		},
+		{
+			name:    "malformed",
+			frames:  [][]byte{{frameFragment, fragmentKindText, 0, 0}},
+			wantErr: errMalformedFragment,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReassembler(1024)
+			r.feed(tt.frames...)
+
+			if len(r.messages) != len(tt.want) {
+				t.Fatalf("got %d messages, want %d", len(r.messages), len(tt.want))
+			}
+			for i, msg := range r.messages {
+				if !bytes.Equal(msg.Data, tt.want[i]) {
+					t.Errorf("message %d = %q, want %q", i, msg.Data, tt.want[i])
+				}
+			}
+			if len(tt.want) == 1 && r.messages[0].IsString != tt.wantText {
+				t.Errorf("IsString = %v, want %v", r.messages[0].IsString, tt.wantText)
+			}
+
+			var err error
+			select {
+			case err = <-r.errs:
+			default:
+			}
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReassembleLimitsPartialMessages(t *testing.T) {
+	r := newReassembler(1024)
+	for id := uint32(1); id <= maxPartialMessages; id++ {
+		r.feed(fragmentFrame(fragmentKindText, id, 0, 8, []byte("half")))
+	}
+	select {
+	case err := <-r.errs:
+		t.Fatalf("unexpected error below the limit: %v", err)
+	default:
+	}
+
+	r.feed(fragmentFrame(fragmentKindText, maxPartialMessages+1, 0, 8, []byte("half")))
+	if err := <-r.errs; !errors.Is(err, errTooManyPartials) {
+		t.Fatalf("error = %v, want %v", err, errTooManyPartials)
+	}
+
+	// Finishing a message makes room for another
+	r.feed(fragmentFrame(fragmentKindText, 1, 1, 8, []byte("done")))
+	r.feed(fragmentFrame(fragmentKindText, maxPartialMessages+1, 0, 8, []byte("half")))
+	select {
+	case err := <-r.errs:
+		t.Fatalf("unexpected error after a message completed: %v", err)
+	default:
+	}
+	if len(r.messages) != 1 || string(r.messages[0].Data) != "halfdone" {
+		t.Fatalf("got %d messages, want the first one completed", len(r.messages))
+	}
+}
+
+func TestReassemblyTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { reassemblyTimeout = timeout }(reassemblyTimeout)
+	reassemblyTimeout = 20 * time.Millisecond
+
+	r := newReassembler(1024)
+	r.feed(fragmentFrame(fragmentKindText, 7, 0, 8, []byte("half")))
+	select {
+	case err := <-r.errs:
+		if !errors.Is(err, errReassemblyTimeout) {
+			t.Fatalf("error = %v, want %v", err, errReassemblyTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("partial message never timed out")
+	}
+
+	// The rest of the message arriving late is not mistaken for a new one
+	r.feed(fragmentFrame(fragmentKindText, 7, 1, 8, []byte("late")))
+	if err := <-r.errs; !errors.Is(err, errFragmentMissing) {
+		t.Fatalf("late fragment error = %v, want %v", err, errFragmentMissing)
+	}
+	if len(r.messages) != 0 {
+		t.Fatalf("got %d messages after a timeout, want none", len(r.messages))
+	}
+}
+
+func TestFramedChannelRoundTrip(t *testing.T) {
+	dcA, dcB, _, _ := newPair(t, "framing", nil)
+	sender := newFramedChannel(dcA, 1<<20)
+	defer sender.close()
+	receiver := newFramedChannel(dcB, 1<<20)
+	defer receiver.close()
+	received := make(chan webrtc.DataChannelMessage, 8)
+	receiver.OnMessage(func(msg webrtc.DataChannelMessage) { received <- msg })
+
+	tests := []struct {
+		name string
+		text bool
+		data []byte
+	}{
+		{"small text", true, []byte(`{"id":"1"}`)},
+		{"large text", true, bytes.Repeat([]byte("0123456789"), 3*fragmentSize/10+7)},
+		{"small binary", false, []byte{0x02, 'x'}},
+		{"binary starting like a fragment", false, []byte{frameFragment, 1, 2}},
+		{"large binary", false, bytes.Repeat([]byte{0xff, 0x00}, fragmentSize+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send := sender.Send
+			if tt.text {
+				send = sender.SendText
+			}
+			if err := send(tt.data); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case msg := <-received:
+				if msg.IsString != tt.text || !bytes.Equal(msg.Data, tt.data) {
+					t.Fatalf("got %d bytes (text %v), want %d (text %v)", len(msg.Data), msg.IsString, len(tt.data), tt.text)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("message never arrived")
+			}
+		})
+	}
+
+	if err := sender.SendText(make([]byte, 2<<20)); !errors.Is(err, errMessageTooLarge) {
+		t.Fatalf("oversize send error = %v, want %v", err, errMessageTooLarge)
+	}
+}
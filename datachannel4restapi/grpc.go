@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcLabel is the data channel label that carries gRPC calls instead of
+// REST envelopes.
+const grpcLabel = "grpc"
+
+// Every message on a gRPC data channel is one frame:
+//
+//	type(1) | call id(4, big endian) | payload
+//
+// A call starts with a headers frame from the client whose payload is JSON,
+// {"method": "/pkg.Service/Method", "metadata": {"key": ["value"]},
+// "timeout": 1000}, followed by a message frame with the request. The server
+// answers with a headers frame carrying response metadata, a message frame
+// per response and a trailers frame, {"code": 0, "message": "",
+// "metadata": {}}, that ends the call. The client may send a cancel frame at
+// any time. Message frame payloads use gRPC's length-prefixed format:
+//
+//	compressed flag(1) | length(4, big endian) | protobuf message
+//
+// Frame types start at 0x10 so they never clash with fragment frames.
+const (
+	grpcFrameHeaders  byte = 0x10
+	grpcFrameMessage  byte = 0x11
+	grpcFrameTrailers byte = 0x12
+	grpcFrameCancel   byte = 0x13
+)
+
+const grpcFrameHeaderSize = 5
+
+// maxPendingGRPCCalls caps the calls per channel whose headers have arrived
+// but whose request message has not.
+const maxPendingGRPCCalls = 16
+
+// grpcCallHeaders is the payload of a headers frame. The server's only
+// carries metadata.
+type grpcCallHeaders struct {
+	Method   string      `json:"method,omitempty"`
+	Metadata metadata.MD `json:"metadata,omitempty"`
+	Timeout  int64       `json:"timeout,omitempty"`
+}
+
+// grpcCallTrailers is the payload of a trailers frame.
+type grpcCallTrailers struct {
+	Code     codes.Code  `json:"code"`
+	Message  string      `json:"message,omitempty"`
+	Metadata metadata.MD `json:"metadata,omitempty"`
+}
+
+// grpcMethod is a registered unary or server-streaming method.
+type grpcMethod struct {
+	impl   any
+	unary  *grpc.MethodDesc
+	stream *grpc.StreamDesc
+}
+
+// GRPCServer serves gRPC services over data channels. It implements
+// grpc.ServiceRegistrar, so generated RegisterXxxServer functions work with
+// it. Client-streaming and bidirectional methods are not supported.
+type GRPCServer struct {
+	mu      sync.RWMutex
+	methods map[string]*grpcMethod
+}
+
+var grpcServer = NewGRPCServer()
+
+func NewGRPCServer() *GRPCServer {
+	return &GRPCServer{methods: make(map[string]*grpcMethod)}
+}
+
+// RegisterService registers impl for every method of desc.
+func (s *GRPCServer) RegisterService(desc *grpc.ServiceDesc, impl any) {
+	if impl != nil {
+		handlerType := reflect.TypeOf(desc.HandlerType).Elem()
+		if !reflect.TypeOf(impl).Implements(handlerType) {
+			log.Fatalf("gRPC: %T does not implement %s", impl, handlerType)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range desc.Methods {
+		m := &desc.Methods[i]
+		s.methods["/"+desc.ServiceName+"/"+m.MethodName] = &grpcMethod{impl: impl, unary: m}
+	}
+	for i := range desc.Streams {
+		sd := &desc.Streams[i]
+		s.methods["/"+desc.ServiceName+"/"+sd.StreamName] = &grpcMethod{impl: impl, stream: sd}
+	}
+	log.Printf("Registered gRPC service %s", desc.ServiceName)
+}
+
+func (s *GRPCServer) lookup(method string) (*grpcMethod, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.methods[method]
+	return m, ok
+}
+
+// grpcChannel serves gRPC calls arriving on one data channel.
+type grpcChannel struct {
+	server  *GRPCServer
+	channel *framedChannel
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	calls   map[uint32]*grpcCall
+	pending int // calls waiting for their request message
+}
+
+// newGRPCChannel serves calls arriving on dc until it closes or ctx, the peer
+// connection's context, is cancelled.
+func newGRPCChannel(ctx context.Context, dc *webrtc.DataChannel, server *GRPCServer) *grpcChannel {
+	ctx, cancel := context.WithCancel(ctx)
+	gc := &grpcChannel{
+		server:  server,
+		channel: newFramedChannel(dc, maxMessageSize),
+		ctx:     ctx,
+		cancel:  cancel,
+		calls:   make(map[uint32]*grpcCall),
+	}
+	gc.channel.OnError(func(id uint32, err error) {
+		log.Printf("Dropping fragmented gRPC frame %d: %v", id, err)
+	})
+	gc.channel.OnMessage(gc.handleMessage)
+	return gc
+}
+
+func (gc *grpcChannel) handleMessage(msg webrtc.DataChannelMessage) {
+	if msg.IsString || len(msg.Data) < grpcFrameHeaderSize {
+		log.Printf("Dropping malformed gRPC frame of %d bytes", len(msg.Data))
+		return
+	}
+	id := binary.BigEndian.Uint32(msg.Data[1:])
+	payload := msg.Data[grpcFrameHeaderSize:]
+
+	switch msg.Data[0] {
+	case grpcFrameHeaders:
+		gc.startCall(id, payload)
+	case grpcFrameMessage:
+		gc.receiveMessage(id, payload)
+	case grpcFrameCancel:
+		gc.mu.Lock()
+		call, ok := gc.calls[id]
+		gc.mu.Unlock()
+		if ok {
+			log.Printf("gRPC call %d %s cancelled by client", id, call.method)
+			call.cancel()
+		}
+	default:
+		log.Printf("Dropping gRPC frame of unknown type 0x%02x", msg.Data[0])
+	}
+}
+
+// startCall sets up call id from its headers; it runs once the request
+// message arrives.
+func (gc *grpcChannel) startCall(id uint32, payload []byte) {
+	var headers grpcCallHeaders
+	if err := json.Unmarshal(payload, &headers); err != nil {
+		gc.sendTrailers(id, status.New(codes.InvalidArgument, "invalid call headers: "+err.Error()), nil)
+		return
+	}
+	method, ok := gc.server.lookup(headers.Method)
+	if !ok {
+		gc.sendTrailers(id, status.Newf(codes.Unimplemented, "unknown method %s", headers.Method), nil)
+		return
+	}
+	if method.stream != nil && method.stream.ClientStreams {
+		gc.sendTrailers(id, status.Newf(codes.Unimplemented, "client streaming method %s is not supported", headers.Method), nil)
+		return
+	}
+	if wait, ok := allowCall(gc.ctx, http.MethodPost, headers.Method); !ok {
+		seconds := retryAfter(wait)
+		gc.sendTrailers(id, status.Newf(codes.ResourceExhausted, "rate limit exceeded, retry in %d s", seconds),
+			metadata.Pairs("retry-after", strconv.Itoa(seconds)))
+		return
+	}
+
+	// Calls without a timeout of their own get the default, like REST
+	// requests, so that one whose request never arrives does not linger
+	ctx, cancel := gc.ctx, context.CancelFunc(func() {})
+	timeout := requestTimeout
+	if headers.Timeout > 0 {
+		timeout = time.Duration(headers.Timeout) * time.Millisecond
+	}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	ctx, cancelCall := context.WithCancel(ctx)
+	call := &grpcCall{
+		gc:     gc,
+		id:     id,
+		method: headers.Method,
+		desc:   method,
+		cancel: func() { cancelCall(); cancel() },
+	}
+	ctx = metadata.NewIncomingContext(ctx, headers.Metadata)
+	call.ctx = grpc.NewContextWithServerTransportStream(ctx, grpcTransportStream{call})
+
+	gc.mu.Lock()
+	_, exists := gc.calls[id]
+	full := gc.pending >= maxPendingGRPCCalls
+	if !exists && !full {
+		gc.calls[id] = call
+		gc.pending++
+	}
+	gc.mu.Unlock()
+	switch {
+	case exists:
+		call.cancel()
+		gc.sendTrailers(id, status.Newf(codes.AlreadyExists, "call %d is already in progress", id), nil)
+		return
+	case full:
+		call.cancel()
+		gc.sendTrailers(id, status.Newf(codes.ResourceExhausted, "more than %d calls are waiting for their request", maxPendingGRPCCalls), nil)
+		return
+	}
+
+	// Drop calls whose request never arrives
+	context.AfterFunc(call.ctx, func() {
+		if gc.start(call) {
+			gc.finish(call, status.FromContextError(call.ctx.Err()).Err())
+		}
+	})
+}
+
+// receiveMessage starts call id with its request message.
+func (gc *grpcChannel) receiveMessage(id uint32, payload []byte) {
+	gc.mu.Lock()
+	call, ok := gc.calls[id]
+	gc.mu.Unlock()
+	if !ok {
+		log.Printf("Dropping gRPC message for unknown call %d", id)
+		return
+	}
+
+	request, err := parseGRPCMessage(payload)
+	if !gc.start(call) {
+		log.Printf("Dropping extra gRPC message for call %d %s", id, call.method)
+		return
+	}
+	if err != nil {
+		gc.finish(call, err)
+		return
+	}
+	call.request = request
+	go call.run()
+}
+
+// start marks call as no longer waiting for its request message. Only the
+// first caller gets true.
+func (gc *grpcChannel) start(call *grpcCall) bool {
+	if !call.started.CompareAndSwap(false, true) {
+		return false
+	}
+	gc.mu.Lock()
+	gc.pending--
+	gc.mu.Unlock()
+	return true
+}
+
+// finish ends call with err's status and forgets it.
+func (gc *grpcChannel) finish(call *grpcCall, err error) {
+	gc.mu.Lock()
+	delete(gc.calls, call.id)
+	gc.mu.Unlock()
+	call.cancel()
+
+	st := status.Convert(err)
+	if st.Code() != codes.OK {
+		log.Printf("gRPC call %d %s failed: %s: %s", call.id, call.method, st.Code(), st.Message())
+	}
+	if gc.ctx.Err() != nil {
+		return // Nobody left to answer
+	}
+	call.mu.Lock()
+	trailer := call.trailer
+	call.mu.Unlock()
+	gc.sendTrailers(call.id, st, trailer)
+}
+
+func (gc *grpcChannel) sendTrailers(id uint32, st *status.Status, md metadata.MD) {
+	payload, _ := json.Marshal(grpcCallTrailers{Code: st.Code(), Message: st.Message(), Metadata: md})
+	if err := gc.channel.Send(grpcFrame(grpcFrameTrailers, id, payload)); err != nil {
+		log.Printf("Failed to send gRPC trailers for call %d: %v", id, err)
+	}
+}
+
+// sendStats describes the channel's send queue.
+func (gc *grpcChannel) sendStats() sendQueueStats {
+	return gc.channel.stats()
+}
+
+// close cancels every call still running on the channel.
+func (gc *grpcChannel) close() {
+	gc.cancel()
+	gc.channel.close()
+}
+
+// grpcCall is one call on a gRPC data channel. It is the grpc.ServerStream
+// handed to streaming handlers.
+type grpcCall struct {
+	gc      *grpcChannel
+	id      uint32
+	method  string
+	desc    *grpcMethod
+	ctx     context.Context
+	cancel  context.CancelFunc
+	request []byte
+	started atomic.Bool // set once the call runs or is abandoned
+
+	mu         sync.Mutex
+	header     metadata.MD
+	trailer    metadata.MD
+	headerSent bool
+	received   bool
+}
+
+func (c *grpcCall) run() {
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("gRPC call %d %s panicked: %v", c.id, c.method, r)
+			err = status.Errorf(codes.Internal, "panic: %v", r)
+		}
+		// A cancelled or timed-out call ends with that status, whatever
+		// the handler returned
+		if c.ctx.Err() != nil {
+			err = status.FromContextError(c.ctx.Err()).Err()
+		}
+		c.gc.finish(c, err)
+	}()
+
+	if c.desc.unary != nil {
+		dec := func(v any) error { return c.RecvMsg(v) }
+		var response any
+		response, err = c.desc.unary.Handler(c.desc.impl, c.ctx, dec, nil)
+		if err == nil {
+			err = c.SendMsg(response)
+		}
+		return
+	}
+	err = c.desc.stream.Handler(c.desc.impl, c)
+}
+
+func (c *grpcCall) Context() context.Context {
+	return c.ctx
+}
+
+func (c *grpcCall) SetHeader(md metadata.MD) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.headerSent {
+		return status.Error(codes.Internal, "headers already sent")
+	}
+	c.header = metadata.Join(c.header, md)
+	return nil
+}
+
+func (c *grpcCall) SendHeader(md metadata.MD) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.headerSent {
+		return status.Error(codes.Internal, "headers already sent")
+	}
+	c.header = metadata.Join(c.header, md)
+	return c.sendHeaderLocked()
+}
+
+func (c *grpcCall) sendHeaderLocked() error {
+	c.headerSent = true
+	payload, err := json.Marshal(grpcCallHeaders{Metadata: c.header})
+	if err != nil {
+		return err
+	}
+	return c.gc.channel.Send(grpcFrame(grpcFrameHeaders, c.id, payload))
+}
+
+func (c *grpcCall) SetTrailer(md metadata.MD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trailer = metadata.Join(c.trailer, md)
+}
+
+// SendMsg sends a response message, sending the headers first if needed.
+func (c *grpcCall) SendMsg(m any) error {
+	if err := c.ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return status.Errorf(codes.Internal, "%T is not a protobuf message", m)
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return status.Errorf(codes.Internal, "marshal response: %v", err)
+	}
+	if len(data)+2*grpcFrameHeaderSize > maxMessageSize {
+		return status.Errorf(codes.ResourceExhausted, "response of %d bytes exceeds maximum message size", len(data))
+	}
+
+	c.mu.Lock()
+	if !c.headerSent {
+		if err := c.sendHeaderLocked(); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+	}
+	c.mu.Unlock()
+
+	frame := grpcFrame(grpcFrameMessage, c.id, make([]byte, grpcFrameHeaderSize+len(data)))
+	binary.BigEndian.PutUint32(frame[grpcFrameHeaderSize+1:], uint32(len(data)))
+	copy(frame[2*grpcFrameHeaderSize:], data)
+	return c.gc.channel.Send(frame)
+}
+
+// RecvMsg reads the call's single request message.
+func (c *grpcCall) RecvMsg(m any) error {
+	c.mu.Lock()
+	received := c.received
+	c.received = true
+	c.mu.Unlock()
+	if received {
+		return io.EOF
+	}
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return status.Errorf(codes.Internal, "%T is not a protobuf message", m)
+	}
+	if err := proto.Unmarshal(c.request, msg); err != nil {
+		return status.Errorf(codes.InvalidArgument, "unmarshal request: %v", err)
+	}
+	return nil
+}
+
+// grpcTransportStream lets unary handlers call grpc.SetHeader,
+// grpc.SendHeader and grpc.SetTrailer.
+type grpcTransportStream struct {
+	call *grpcCall
+}
+
+func (s grpcTransportStream) Method() string                  { return s.call.method }
+func (s grpcTransportStream) SetHeader(md metadata.MD) error  { return s.call.SetHeader(md) }
+func (s grpcTransportStream) SendHeader(md metadata.MD) error { return s.call.SendHeader(md) }
+func (s grpcTransportStream) SetTrailer(md metadata.MD) error {
+	s.call.SetTrailer(md)
+	return nil
+}
+
+// grpcFrame builds a frame of the given type for call id.
+func grpcFrame(frameType byte, id uint32, payload []byte) []byte {
+	frame := make([]byte, grpcFrameHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], id)
+	copy(frame[grpcFrameHeaderSize:], payload)
+	return frame
+}
+
+// parseGRPCMessage unwraps a length-prefixed gRPC message.
+func parseGRPCMessage(payload []byte) ([]byte, error) {
+	if len(payload) < grpcFrameHeaderSize {
+		return nil, status.Error(codes.InvalidArgument, "truncated message")
+	}
+	if payload[0] != 0 {
+		return nil, status.Error(codes.Unimplemented, "compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(payload[1:])
+	if int(length) != len(payload)-grpcFrameHeaderSize {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("message length %d does not match frame", length))
+	}
+	return payload[grpcFrameHeaderSize:], nil
+}
+
+var _ grpc.ServiceRegistrar = (*GRPCServer)(nil)
+var _ grpc.ServerStream = (*grpcCall)(nil)
+var _ grpc.ServerTransportStream = grpcTransportStream{}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// newTestGRPCChannel serves the health service on one end of a pair and
+// returns the other end with the trailers it receives.
+func newTestGRPCChannel(t *testing.T) (*webrtc.DataChannel, chan grpcCallTrailers) {
+	server := NewGRPCServer()
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	dcA, dcB, _, _ := newPair(t, grpcLabel, nil)
+	gc := newGRPCChannel(context.Background(), dcB, server)
+	t.Cleanup(gc.close)
+
+	trailers := make(chan grpcCallTrailers, maxPendingGRPCCalls+1)
+	dcA.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if len(msg.Data) < grpcFrameHeaderSize || msg.Data[0] != grpcFrameTrailers {
+			return
+		}
+		var tr grpcCallTrailers
+		if err := json.Unmarshal(msg.Data[grpcFrameHeaderSize:], &tr); err != nil {
+			t.Errorf("trailers of call %d: %v", binary.BigEndian.Uint32(msg.Data[1:]), err)
+		}
+		trailers <- tr
+	})
+	return dcA, trailers
+}
+
+// sendCallHeaders starts call id without sending its request.
+func sendCallHeaders(t *testing.T, dc *webrtc.DataChannel, id uint32, timeout int64) {
+	payload, _ := json.Marshal(grpcCallHeaders{Method: "/grpc.health.v1.Health/Check", Timeout: timeout})
+	if err := dc.Send(grpcFrame(grpcFrameHeaders, id, payload)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGRPCPendingCallsTimeOut(t *testing.T) {
+	defer func(timeout time.Duration) { requestTimeout = timeout }(requestTimeout)
+	requestTimeout = 50 * time.Millisecond
+	dc, trailers := newTestGRPCChannel(t)
+
+	sendCallHeaders(t, dc, 1, 0)
+	select {
+	case tr := <-trailers:
+		if tr.Code != codes.DeadlineExceeded {
+			t.Fatalf("code = %s, want %s", tr.Code, codes.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("call without a request never timed out")
+	}
+}
+
+func TestGRPCPendingCallsLimit(t *testing.T) {
+	dc, trailers := newTestGRPCChannel(t)
+	for id := uint32(1); id <= maxPendingGRPCCalls; id++ {
+		sendCallHeaders(t, dc, id, 60000)
+	}
+	sendCallHeaders(t, dc, maxPendingGRPCCalls+1, 60000)
+	select {
+	case tr := <-trailers:
+		if tr.Code != codes.ResourceExhausted {
+			t.Fatalf("code = %s, want %s", tr.Code, codes.ResourceExhausted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("call over the limit never refused")
+	}
+	select {
+	case tr := <-trailers:
+		t.Fatalf("unexpected trailers %+v", tr)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header holds envelope headers with the semantics of http.Header: keys are
+// canonicalised, so "content-type" and "Content-Type" are the same header,
+// and a header may have several values. On the wire a header with a single
+// value is a string and a repeated one is an array of strings:
+//
+//	{"Content-Type": "application/json", "Set-Cookie": ["a=1", "b=2"]}
+//
+// Both forms are accepted from clients.
+type Header http.Header
+
+func (h Header) Get(key string) string {
+	return http.Header(h).Get(key)
+}
+
+func (h Header) Values(key string) []string {
+	return http.Header(h).Values(key)
+}
+
+func (h Header) Set(key, value string) {
+	http.Header(h).Set(key, value)
+}
+
+func (h Header) Add(key, value string) {
+	http.Header(h).Add(key, value)
+}
+
+func (h Header) Del(key string) {
+	http.Header(h).Del(key)
+}
+
+// Clone returns a copy of h. Unlike http.Header.Clone it never returns nil,
+// so the copy can always be written to.
+func (h Header) Clone() Header {
+	if h == nil {
+		return Header{}
+	}
+	return Header(http.Header(h).Clone())
+}
+
+func (h Header) MarshalJSON() ([]byte, error) {
+	members := make(map[string]interface{}, len(h))
+	for key, values := range h {
+		switch len(values) {
+		case 0:
+		case 1:
+			members[key] = values[0]
+		default:
+			members[key] = values
+		}
+	}
+	return json.Marshal(members)
+}
+
+// UnmarshalJSON walks the object in document order, so that the values of
+// differently spelt keys are merged in the order the client sent them.
+func (h *Header) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		*h = nil
+		return nil
+	}
+	if token != json.Delim('{') {
+		return errors.New("headers must be an object")
+	}
+	header := Header{}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key := token.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err == nil {
+			header.Add(key, value)
+			continue
+		}
+		var values []string
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return fmt.Errorf("header %s must be a string or an array of strings", key)
+		}
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	*h = header
+	return nil
+}
+
+// fillRequestHeaders sets the Content-Length and, if the client left them
+// out, the Content-Type and Date of a request about to be handled.
+func fillRequestHeaders(request *RestAPIMessage) {
+	request.Headers = request.Headers.Clone()
+	if request.Headers.Get("Date") == "" {
+		request.Headers.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	size, ok := bodySize(request.Body, request.RawBody)
+	if !ok {
+		request.Headers.Del("Content-Length")
+		return
+	}
+	request.Headers.Set("Content-Length", strconv.Itoa(size))
+	if size > 0 && request.Headers.Get("Content-Type") == "" {
+		request.Headers.Set("Content-Type", requestContentType(*request))
+	}
+}
+
+// fillResponseHeaders sets the Date and Content-Length of a response about
+// to be sent, and its Content-Type if the handler did not. Streamed
+// responses have no length.
+func fillResponseHeaders(response *RestAPIResponse) {
+	response.Headers = response.Headers.Clone()
+	response.Headers.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if response.Headers.Get("Content-Type") == "" {
+		if contentType := responseContentType(*response); contentType != "" {
+			response.Headers.Set("Content-Type", contentType)
+		}
+	}
+	size, ok := bodySize(response.Body, response.RawBody)
+	if !ok || response.Streamer != nil {
+		response.Headers.Del("Content-Length")
+		return
+	}
+	response.Headers.Set("Content-Length", strconv.Itoa(size))
+}
+
+// responseContentType is the Content-Type of a response whose handler did
+// not set one, or "" if it has no body.
+func responseContentType(response RestAPIResponse) string {
+	switch response.Body.(type) {
+	case nil:
+		if response.RawBody != nil {
+			return http.DetectContentType(response.RawBody)
+		}
+		return ""
+	case string:
+		return "text/plain; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// bodySize is the length in bytes of an envelope body: the raw bytes, the
+// text of a string body, or the JSON encoding of anything else.
+func bodySize(body interface{}, raw []byte) (int, bool) {
+	if raw != nil {
+		return len(raw), true
+	}
+	switch b := body.(type) {
+	case nil:
+		return 0, true
+	case string:
+		return len(b), true
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, false
+	}
+	return len(data), true
+}
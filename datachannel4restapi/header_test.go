@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    Header
+		wantErr bool
+	}{
+		{
+			name: "strings",
+			data: `{"Content-Type": "application/json", "Accept": "*/*"}`,
+			want: Header{"Content-Type": {"application/json"}, "Accept": {"*/*"}},
+		},
+		{
+			name: "arrays",
+			data: `{"Set-Cookie": ["a=1", "b=2"]}`,
+			want: Header{"Set-Cookie": {"a=1", "b=2"}},
+		},
+		{
+			name: "keys are canonicalised",
+			data: `{"content-type": "text/plain", "x-request-id": ["7"]}`,
+			want: Header{"Content-Type": {"text/plain"}, "X-Request-Id": {"7"}},
+		},
+		{
+			name: "spellings of one key are merged",
+			data: `{"accept": "text/html", "ACCEPT": "text/plain"}`,
+			want: Header{"Accept": {"text/html", "text/plain"}},
+		},
+		{
+			name: "merged values keep document order",
+			data: `{"X-Tag": "c", "x-tag": ["a", "d"], "X-TAG": "b"}`,
+			want: Header{"X-Tag": {"c", "a", "d", "b"}},
+		},
+		{
+			name: "empty array",
+			data: `{"Accept": []}`,
+			want: Header{},
+		},
+		{
+			name: "null",
+			data: `null`,
+			want: nil,
+		},
+		{
+			name:    "number",
+			data:    `{"Content-Length": 12}`,
+			wantErr: true,
+		},
+		{
+			name:    "array of numbers",
+			data:    `{"Accept": [1, 2]}`,
+			wantErr: true,
+		},
+		{
+			name:    "not an object",
+			data:    `["Accept"]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Header
+			err := json.Unmarshal([]byte(tt.data), &h)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(h, tt.want) {
+				t.Fatalf("got %v, want %v", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderMarshalJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		header Header
+		want   string
+	}{
+		{"nil", nil, `{}`},
+		{"single value is a string", Header{"Content-Type": {"text/plain"}}, `{"Content-Type":"text/plain"}`},
+		{"repeated value is an array", Header{"Set-Cookie": {"a=1", "b=2"}}, `{"Set-Cookie":["a=1","b=2"]}`},
+		{"no values is left out", Header{"Accept": {}}, `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Fatalf("got %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderInEnvelope(t *testing.T) {
+	var request RestAPIMessage
+	data := `{"id": "1", "method": "GET", "endpoint": "/", "headers": {"accept": "text/plain", "x-tag": ["a", "b"]}}`
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		t.Fatal(err)
+	}
+	if got := request.Headers.Get("Accept"); got != "text/plain" {
+		t.Errorf("Accept = %q, want text/plain", got)
+	}
+	if got := request.Headers.Values("X-Tag"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("X-Tag = %q, want [a b]", got)
+	}
+
+	var round RestAPIMessage
+	encoded, _ := json.Marshal(request)
+	if err := json.Unmarshal(encoded, &round); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(round.Headers, request.Headers) {
+		t.Errorf("headers after a round trip = %v, want %v", round.Headers, request.Headers)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// version is the build version, set at link time with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+var startTime = time.Now()
+
+// draining is set once the server has been asked to shut down. It stops
+// accepting sessions and reports itself not ready, and the sessions it
+// still has get up to drainTimeout to finish.
+var (
+	draining     atomic.Bool
+	drainTimeout = 30 * time.Second
+)
+
+// sessions holds every connected signaling session.
+var sessions = &sessionSet{clients: make(map[*Client]struct{})}
+
+type sessionSet struct {
+	mu      sync.Mutex
+	clients map[*Client]struct{}
+}
+
+func (s *sessionSet) add(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c] = struct{}{}
+}
+
+func (s *sessionSet) remove(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c)
+}
+
+// counts returns the number of sessions and of data channels they serve.
+func (s *sessionSet) counts() (sessions, channels int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.clients {
+		channels += c.channelCount()
+	}
+	return len(s.clients), channels
+}
+
+// closeAll ends every session.
+func (s *sessionSet) closeAll(reason string) {
+	s.mu.Lock()
+	clients := make([]*Client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+	for _, c := range clients {
+		c.closeSession(reason)
+	}
+}
+
+type clientKey struct{}
+
+// withClient returns a context carrying the session c. Every request a
+// session sends is handled with a context derived from it.
+func withClient(ctx context.Context, c *Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, c)
+}
+
+// clientFrom returns the session a request came from, or nil when it did
+// not arrive over a data channel.
+func clientFrom(ctx context.Context) *Client {
+	c, _ := ctx.Value(clientKey{}).(*Client)
+	return c
+}
+
+// getHealth reports the server's state and, when called over a data
+// channel, the state of the caller's own connection. It answers 200 even
+// while draining, as the process is still alive.
+func getHealth(req *Request) RestAPIResponse {
+	now := time.Now()
+	sessionCount, channelCount := sessions.counts()
+	status := "healthy"
+	if draining.Load() {
+		status = "draining"
+	}
+	body := map[string]interface{}{
+		"status":        status,
+		"timestamp":     now.UTC().Format(time.RFC3339),
+		"startedAt":     startTime.UTC().Format(time.RFC3339),
+		"uptimeSeconds": int64(now.Sub(startTime).Seconds()),
+		"version":       version,
+		"sessions":      sessionCount,
+		"dataChannels":  channelCount,
+	}
+	if c := clientFrom(req.Context()); c != nil {
+		session := map[string]interface{}{
+			"id":           c.id,
+			"dataChannels": c.channelCount(),
+			"sendQueue":    c.sendStats(),
+		}
+		if pc := c.peerConn; pc != nil {
+			session["peerConnectionState"] = pc.ConnectionState().String()
+			session["iceConnectionState"] = pc.ICEConnectionState().String()
+			session["iceGatheringState"] = pc.ICEGatheringState().String()
+			session["signalingState"] = pc.SignalingState().String()
+		}
+		body["session"] = session
+	}
+	return jsonResponse(http.StatusOK, body)
+}
+
+// getReady tells load balancers whether to send new sessions here.
+func getReady(req *Request) RestAPIResponse {
+	if draining.Load() {
+		response := newProblem(http.StatusServiceUnavailable, "", "Server is draining").Response()
+		response.Headers.Set("Retry-After", "30")
+		return response
+	}
+	return jsonResponse(http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// drainOnSignal waits for SIGTERM or an interrupt, then drains: new
+// sessions are refused and /api/health/ready fails, while existing sessions
+// get drainTimeout to end before they are closed and server shuts down.
+func drainOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	signal.Stop(signals)
+
+	draining.Store(true)
+	count, _ := sessions.counts()
+	log.Printf("🛑 Received %v, draining %d sessions for up to %v", sig, count, drainTimeout)
+
+	deadline := time.Now().Add(drainTimeout)
+	for count > 0 && time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+		count, _ = sessions.counts()
+	}
+	if count > 0 {
+		sessions.closeAll("server is shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down cleanly: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// queuedStub is a channel service with fixed send queue statistics.
+type queuedStub sendQueueStats
+
+func (queuedStub) close() {}
+
+func (s queuedStub) sendStats() sendQueueStats { return sendQueueStats(s) }
+
+func TestHealthSendQueue(t *testing.T) {
+	tests := []struct {
+		name     string
+		channels []channelService
+		want     sendQueueStats
+	}{
+		{"no channels", nil, sendQueueStats{}},
+		{
+			name:     "summed over channels",
+			channels: []channelService{queuedStub{Queued: 2, Dropped: 1}, queuedStub{Queued: 3, Sent: 9, Dropped: 4}},
+			want:     sendQueueStats{Queued: 5, Sent: 9, Dropped: 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{id: "test", channels: make(map[*webrtc.DataChannel]channelService)}
+			for _, service := range tt.channels {
+				c.channels[&webrtc.DataChannel{}] = service
+			}
+			req := newRequest(withClient(context.Background(), c), RestAPIMessage{Method: "GET", Endpoint: "/api/health"})
+			body := getHealth(req).Body.(map[string]interface{})
+			session, ok := body["session"].(map[string]interface{})
+			if !ok {
+				t.Fatal("no session in health report")
+			}
+			if got := session["sendQueue"]; got != tt.want {
+				t.Fatalf("sendQueue = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// handlerMount serves endpoints under prefix with a standard http.Handler.
+type handlerMount struct {
+	prefix  string
+	handler http.Handler
+}
+
+// handlerMounts holds the http.Handlers reachable over the data channel,
+// longest prefix first.
+var handlerMounts []handlerMount
+
+// mountHandler makes h reachable over the data channel for every endpoint
+// under prefix. The handler sees the full endpoint path, so the same handler
+// or http.ServeMux can also be registered with the HTTPS server unchanged.
+func mountHandler(prefix string, h http.Handler) {
+	handlerMounts = append(handlerMounts, handlerMount{prefix: strings.TrimSuffix(prefix, "/"), handler: h})
+	sort.SliceStable(handlerMounts, func(i, j int) bool {
+		return len(handlerMounts[i].prefix) > len(handlerMounts[j].prefix)
+	})
+}
+
+// matchHandler returns the mounted handler serving endpoint, or nil.
+func matchHandler(endpoint string) http.Handler {
+	path, _, _ := strings.Cut(endpoint, "?")
+	for _, mount := range handlerMounts {
+		if path == mount.prefix || strings.HasPrefix(path, mount.prefix+"/") {
+			return mount.handler
+		}
+	}
+	return nil
+}
+
+// serveHTTPHandler runs request through h as if it had arrived over HTTP and
+// converts whatever h wrote into a RestAPIResponse. ctx becomes the
+// http.Request's context.
+func serveHTTPHandler(ctx context.Context, h http.Handler, request RestAPIMessage) RestAPIResponse {
+	body, err := encodeRequestBody(request)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "Invalid request body")
+	}
+
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, request.Endpoint, body)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "Invalid request")
+	}
+	httpReq.RequestURI = request.Endpoint
+	httpReq.RemoteAddr = "webrtc"
+	httpReq.Header = http.Header(request.Headers.Clone())
+	if body != nil && httpReq.Header.Get("Content-Type") == "" {
+		httpReq.Header.Set("Content-Type", requestContentType(request))
+	}
+
+	rec := newResponseRecorder()
+	h.ServeHTTP(rec, httpReq)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	headers := Header(rec.header.Clone())
+	if headers.Get("Content-Type") == "" && rec.body.Len() > 0 {
+		headers.Set("Content-Type", http.DetectContentType(rec.body.Bytes()))
+	}
+	headers.Del("Content-Length")
+
+	response := RestAPIResponse{Status: rec.status, Headers: headers}
+	response.Body, response.RawBody = decodeBody(headers.Get("Content-Type"), rec.body.Bytes())
+	return response
+}
+
+// routerHandler serves r's endpoints over HTTPS as well as the data
+// channel. Streaming responses are only available on the data channel.
+func routerHandler(r *Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, int64(maxMessageSize)))
+		if err != nil {
+			writeHTTPResponse(w, newProblem(http.StatusRequestEntityTooLarge, problemTooLarge, "Request body exceeds maximum message size").Response())
+			return
+		}
+		request := RestAPIMessage{
+			Method:   req.Method,
+			Endpoint: req.URL.RequestURI(),
+			Headers:  Header(req.Header.Clone()),
+		}
+		request.Body, request.RawBody = decodeBody(req.Header.Get("Content-Type"), data)
+		fillRequestHeaders(&request)
+		writeHTTPResponse(w, r.Serve(req.Context(), request))
+	})
+}
+
+// writeHTTPResponse writes response to w the way the data channel would
+// carry it: RawBody as-is, string bodies as text and anything else as JSON.
+func writeHTTPResponse(w http.ResponseWriter, response RestAPIResponse) {
+	if response.Streamer != nil {
+		response = errorResponse(http.StatusNotImplemented, "Streaming responses are only available over the data channel")
+	}
+	var body []byte
+	switch b := response.Body.(type) {
+	case nil:
+	case string:
+		body = []byte(b)
+	default:
+		var err error
+		if body, err = json.Marshal(b); err != nil {
+			log.Printf("Failed to encode response body: %v", err)
+			response = errorResponse(http.StatusInternalServerError, "Failed to encode response")
+			body, _ = json.Marshal(response.Body)
+		}
+	}
+	if response.RawBody != nil {
+		body = response.RawBody
+	}
+	for key, values := range response.Headers {
+		w.Header()[key] = values
+	}
+	if w.Header().Get("Content-Type") == "" {
+		if contentType := responseContentType(response); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+	}
+	w.WriteHeader(response.Status)
+	w.Write(body)
+}
+
+// encodeRequestBody turns an envelope body into an HTTP request body. Binary
+// and string bodies are sent as-is; anything else is re-encoded as JSON.
+func encodeRequestBody(request RestAPIMessage) (io.Reader, error) {
+	if request.RawBody != nil {
+		return bytes.NewReader(request.RawBody), nil
+	}
+	if request.Body == nil {
+		return nil, nil
+	}
+	if s, ok := request.Body.(string); ok {
+		return strings.NewReader(s), nil
+	}
+	data, err := json.Marshal(request.Body)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// requestContentType is the Content-Type assumed for a request body when the
+// client did not send one.
+func requestContentType(request RestAPIMessage) string {
+	if request.RawBody != nil {
+		return "application/octet-stream"
+	}
+	return "application/json"
+}
+
+// responseRecorder is a minimal http.ResponseWriter that buffers the response
+// in memory.
+type responseRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+	status int
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: make(http.Header)}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(p)
+}
+
+// Flush implements http.Flusher. The whole body is sent at once, so there is
+// nothing to do.
+func (r *responseRecorder) Flush() {}
+
+// echoHandler is a plain http.Handler that reports the request back to the
+// caller. It is served both over HTTPS and over the data channel.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	var body interface{}
+	if data, err := io.ReadAll(r.Body); err == nil && len(data) > 0 {
+		var raw []byte
+		if body, raw = decodeBody(r.Header.Get("Content-Type"), data); raw != nil {
+			body = map[string]int{"bytes": len(raw)}
+		}
+	}
+	log.Printf("Echo handler: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"query":   r.URL.Query(),
+		"headers": r.Header,
+		"body":    body,
+		"remote":  r.RemoteAddr,
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests that change state may carry an Idempotency-Key header, so that a
+// client whose data channel dropped can retry them safely. The first
+// response to each key is kept for idempotencyWindow and replayed, marked
+// with Idempotent-Replayed, to every retry with the same method, endpoint
+// and body. Reusing a key for a different request answers 422, and a retry
+// that arrives while the first request is still running answers 409.
+// Server errors are not kept, so retrying after one runs the request again.
+//
+// Keys belong to the user named by the request's Authorization header, or
+// without one to the session, so different users never see each other's
+// responses.
+var idempotencyWindow = 10 * time.Minute
+
+// idempotencyCacheSize bounds the bytes of responses kept for replay. When
+// it is exceeded the least recently used responses are forgotten first.
+var idempotencyCacheSize = 16 << 20
+
+// maxIdempotencyKey bounds the length of an Idempotency-Key.
+const maxIdempotencyKey = 255
+
+type idempotencyEntry struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	response    *RestAPIResponse // nil while the first request runs
+	size        int
+	expires     time.Time
+}
+
+// idempotencyCache holds the responses of recent requests by scope and key,
+// most recently used first.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	lru       list.List
+	size      int
+	lastSweep time.Time
+}
+
+var idempotencyKeys = &idempotencyCache{entries: make(map[string]*list.Element)}
+
+// begin claims key for a request with the given fingerprint. If the key was
+// seen before it returns the earlier entry instead.
+func (c *idempotencyCache) begin(key string, fingerprint [sha256.Size]byte) (*idempotencyEntry, bool) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastSweep) > time.Minute {
+		for _, elem := range c.entries {
+			if entry := elem.Value.(*idempotencyEntry); entry.response != nil && now.After(entry.expires) {
+				c.remove(elem)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*idempotencyEntry)
+		if entry.response == nil || now.Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			copied := *entry
+			return &copied, false
+		}
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&idempotencyEntry{key: key, fingerprint: fingerprint})
+	return nil, true
+}
+
+// finish stores the response to key's first request, forgetting the least
+// recently used responses to make room. A response larger than the whole
+// cache is not kept.
+func (c *idempotencyCache) finish(key string, response RestAPIResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	size := responseSize(key, response)
+	if size > idempotencyCacheSize {
+		c.remove(elem)
+		return
+	}
+	entry := elem.Value.(*idempotencyEntry)
+	entry.response = &response
+	entry.size = size
+	entry.expires = time.Now().Add(idempotencyWindow)
+	c.size += size
+
+	for back := c.lru.Back(); c.size > idempotencyCacheSize && back != nil; {
+		prev := back.Prev()
+		if back.Value.(*idempotencyEntry).response != nil {
+			c.remove(back)
+		}
+		back = prev
+	}
+}
+
+// release forgets key, so a retry runs the request again.
+func (c *idempotencyCache) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// remove drops an entry. c.mu must be held.
+func (c *idempotencyCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*idempotencyEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// responseSize estimates the memory a cached response takes up.
+func responseSize(key string, response RestAPIResponse) int {
+	size := len(key)
+	if body, ok := bodySize(response.Body, response.RawBody); ok {
+		size += body
+	}
+	for name, values := range response.Headers {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return size
+}
+
+// replayIdempotent answers retried requests from idempotencyKeys.
+func replayIdempotent(next Handler) Handler {
+	return func(req *Request) RestAPIResponse {
+		key := req.Headers.Get("Idempotency-Key")
+		if key == "" || idempotencyWindow <= 0 || isSafeMethod(strings.ToUpper(req.Method)) {
+			return next(req)
+		}
+		if len(key) > maxIdempotencyKey {
+			return errorResponse(http.StatusBadRequest, "Idempotency-Key must be at most 255 bytes")
+		}
+		scope := idempotencyScope(req)
+		if scope == "" {
+			return next(req)
+		}
+		key = scope + "\x00" + key
+
+		fingerprint := requestFingerprint(req)
+		if entry, first := idempotencyKeys.begin(key, fingerprint); !first {
+			switch {
+			case entry.fingerprint != fingerprint:
+				return newProblem(http.StatusUnprocessableEntity, problemIdempotencyKeyReused,
+					"Idempotency-Key was already used for a different request").Response()
+			case entry.response == nil:
+				return errorResponse(http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+			}
+			response := *entry.response
+			response.Headers = response.Headers.Clone()
+			response.Headers.Set("Idempotent-Replayed", "true")
+			return response
+		}
+
+		stored := false
+		defer func() {
+			if !stored {
+				idempotencyKeys.release(key)
+			}
+		}()
+		response := next(req)
+		if response.Streamer != nil || response.Status >= 500 {
+			// A stream cannot be replayed and a server error may not
+			// happen again, so a retry runs the request again
+			return response
+		}
+		idempotencyKeys.finish(key, response)
+		stored = true
+		return response
+	}
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// idempotencyScope names the owner of a request's Idempotency-Key, or ""
+// when the request has neither credentials nor a session.
+func idempotencyScope(req *Request) string {
+	if auth := req.Headers.Get("Authorization"); auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		return "user:" + hex.EncodeToString(sum[:])
+	}
+	if c := req.Session(); c != nil {
+		return "session:" + c.id
+	}
+	return ""
+}
+
+// requestFingerprint digests what makes two requests the same: method,
+// endpoint and body. JSON bodies are compared by content, not spelling.
+func requestFingerprint(req *Request) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(strings.ToUpper(req.Method) + " " + req.Endpoint + "\n"))
+	if req.RawBody != nil {
+		h.Write(req.RawBody)
+	} else if req.Body != nil {
+		body, _ := json.Marshal(req.Body)
+		h.Write(body)
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
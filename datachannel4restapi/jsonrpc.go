@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// jsonrpcLabel is the data channel label that carries JSON-RPC 2.0 messages
+// instead of REST envelopes.
+const jsonrpcLabel = "jsonrpc"
+
+// Standard JSON-RPC 2.0 error codes. -32000 to -32099 are left to the
+// server; jsonrpcServerError reports failed REST-backed calls.
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcInternalError  = -32603
+	jsonrpcServerError    = -32000
+)
+
+// A JSON-RPC batch holds at most maxBatchSize requests, like a REST batch,
+// and runs at most jsonrpcBatchConcurrency of them at a time.
+const jsonrpcBatchConcurrency = 8
+
+// JSONRPCError is the error object of a JSON-RPC response. Methods return
+// one to choose the code; any other error becomes a server error.
+type JSONRPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *JSONRPCError) Error() string {
+	return fmt.Sprintf("JSON-RPC error %d: %s", e.Code, e.Message)
+}
+
+// JSONRPCFunc implements a JSON-RPC method. params is the raw "params"
+// member, nil when the request has none.
+type JSONRPCFunc func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// jsonrpcRequest is a request or notification. ID stays nil when the member
+// is absent, which makes the request a notification; an explicit null is
+// kept as the raw bytes "null".
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  *string         `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// JSONRPCServer dispatches JSON-RPC 2.0 requests to registered methods.
+// Methods registered with HandleRoute are served like REST requests, by
+// serve, so both protocols share the same handlers and middleware.
+type JSONRPCServer struct {
+	serve func(ctx context.Context, request RestAPIMessage) RestAPIResponse
+
+	mu      sync.RWMutex
+	methods map[string]JSONRPCFunc
+}
+
+func NewJSONRPCServer(serve func(ctx context.Context, request RestAPIMessage) RestAPIResponse) *JSONRPCServer {
+	return &JSONRPCServer{serve: serve, methods: make(map[string]JSONRPCFunc)}
+}
+
+// Handle registers fn as the method name. Calls are charged to the
+// session's rate limit before fn runs.
+func (s *JSONRPCServer) Handle(name string, fn JSONRPCFunc) {
+	s.register(name, func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		if wait, ok := allowCall(ctx, http.MethodPost, ""); !ok {
+			return routeResult(rateLimitedResponse(wait))
+		}
+		return fn(ctx, params)
+	})
+}
+
+func (s *JSONRPCServer) register(name string, fn JSONRPCFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[name] = fn
+}
+
+// HandleRoute registers the method name as a call to the REST route
+// method pattern. Params must be an object: members named like the
+// pattern's {name} segments fill the path, and the rest become the query
+// string for GET and DELETE or the JSON body otherwise. A 2xx response's
+// body is the result; other statuses become errors carrying the status and
+// body as data. Calls are charged to the rate limit of the route's endpoint
+// like REST requests.
+func (s *JSONRPCServer) HandleRoute(name, method, pattern string) {
+	segments := splitPath(pattern)
+	s.register(name, func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		args := map[string]interface{}{}
+		if len(params) > 0 && string(params) != "null" {
+			if err := json.Unmarshal(params, &args); err != nil {
+				return nil, &JSONRPCError{Code: jsonrpcInvalidParams, Message: "Invalid params: must be an object"}
+			}
+		}
+
+		path := make([]string, len(segments))
+		for i, segment := range segments {
+			param, ok := paramName(segment)
+			if !ok {
+				path[i] = segment
+				continue
+			}
+			value, ok := args[param]
+			if !ok {
+				return nil, &JSONRPCError{Code: jsonrpcInvalidParams, Message: "Invalid params: missing " + param}
+			}
+			path[i] = url.PathEscape(fmt.Sprint(value))
+			delete(args, param)
+		}
+
+		request := RestAPIMessage{
+			Method:   method,
+			Endpoint: "/" + strings.Join(path, "/"),
+			Headers:  Header{"Content-Type": {"application/json"}},
+		}
+		if method == http.MethodGet || method == http.MethodDelete {
+			query := url.Values{}
+			for key, value := range args {
+				query.Set(key, fmt.Sprint(value))
+			}
+			if len(query) > 0 {
+				request.Endpoint += "?" + query.Encode()
+			}
+		} else {
+			request.Body = args
+		}
+		if wait, ok := allowCall(ctx, request.Method, request.Endpoint); !ok {
+			return routeResult(rateLimitedResponse(wait))
+		}
+		fillRequestHeaders(&request)
+		return routeResult(s.serve(ctx, request))
+	})
+}
+
+// routeResult turns a REST response into a JSON-RPC result or error.
+func routeResult(response RestAPIResponse) (interface{}, error) {
+	if response.Streamer != nil {
+		return nil, &JSONRPCError{Code: jsonrpcServerError, Message: "Streaming responses are not supported over JSON-RPC"}
+	}
+	body := response.Body
+	if response.RawBody != nil {
+		body = response.RawBody // Encoded as base64
+	}
+	if response.Status >= 200 && response.Status < 300 {
+		return body, nil
+	}
+
+	code := jsonrpcServerError
+	if response.Status == http.StatusBadRequest || response.Status == http.StatusUnprocessableEntity {
+		code = jsonrpcInvalidParams
+	}
+	message := http.StatusText(response.Status)
+	if problem, ok := body.(*Problem); ok && problem.Detail != "" {
+		message = problem.Detail
+	}
+	return nil, &JSONRPCError{
+		Code:    code,
+		Message: message,
+		Data:    map[string]interface{}{"status": response.Status, "body": body},
+	}
+}
+
+// ServeMessage handles one JSON-RPC message, a request or a batch, and
+// returns the encoded reply, or nil when there is nothing to send back
+// because every request was a notification. A batch is charged to the
+// session's rate limit as a whole before it is decoded, and each of its
+// calls once more as it runs. Batch entries run concurrently; the replies
+// keep the batch's order.
+func (s *JSONRPCServer) ServeMessage(ctx context.Context, data []byte) []byte {
+	data = bytes.TrimSpace(data)
+	if !json.Valid(data) {
+		return mustMarshal(errorReply(nil, jsonrpcParseError, "Parse error"))
+	}
+
+	if len(data) == 0 || data[0] != '[' {
+		if reply := s.serveRequest(ctx, data); reply != nil {
+			return mustMarshal(reply)
+		}
+		return nil
+	}
+
+	if wait, ok := allowSessionCall(ctx, "JSON-RPC batch"); !ok {
+		_, err := routeResult(rateLimitedResponse(wait))
+		return mustMarshal(&jsonrpcResponse{JSONRPC: "2.0", Error: err.(*JSONRPCError), ID: json.RawMessage("null")})
+	}
+	var batch []json.RawMessage
+	if err := json.Unmarshal(data, &batch); err != nil || len(batch) == 0 {
+		return mustMarshal(errorReply(nil, jsonrpcInvalidRequest, "Invalid Request"))
+	}
+	if len(batch) > maxBatchSize {
+		return mustMarshal(errorReply(nil, jsonrpcInvalidRequest, fmt.Sprintf("Invalid Request: batch holds more than %d requests", maxBatchSize)))
+	}
+	replies := make([]*jsonrpcResponse, len(batch))
+	running := make(chan struct{}, jsonrpcBatchConcurrency)
+	var wg sync.WaitGroup
+	for i, raw := range batch {
+		running <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-running; wg.Done() }()
+			replies[i] = s.serveRequest(ctx, raw)
+		}()
+	}
+	wg.Wait()
+
+	var out []*jsonrpcResponse
+	for _, reply := range replies {
+		if reply != nil {
+			out = append(out, reply)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return mustMarshal(out)
+}
+
+// serveRequest runs a single request. It returns nil for notifications,
+// which are never answered, not even with an error.
+func (s *JSONRPCServer) serveRequest(ctx context.Context, raw json.RawMessage) *jsonrpcResponse {
+	var req jsonrpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == nil || !validID(req.ID) {
+		id := req.ID
+		if !validID(id) {
+			id = nil
+		}
+		return errorReply(id, jsonrpcInvalidRequest, "Invalid Request")
+	}
+	notification := req.ID == nil
+	reply := func(result json.RawMessage, rpcErr *JSONRPCError) *jsonrpcResponse {
+		if notification {
+			return nil
+		}
+		return &jsonrpcResponse{JSONRPC: "2.0", Result: result, Error: rpcErr, ID: req.ID}
+	}
+
+	if len(req.Params) > 0 && req.Params[0] != '{' && req.Params[0] != '[' {
+		return reply(nil, &JSONRPCError{Code: jsonrpcInvalidParams, Message: "Invalid params: must be an object or array"})
+	}
+	s.mu.RLock()
+	fn, ok := s.methods[*req.Method]
+	s.mu.RUnlock()
+	if !ok {
+		return reply(nil, &JSONRPCError{Code: jsonrpcMethodNotFound, Message: "Method not found"})
+	}
+
+	result, err := callJSONRPC(ctx, fn, req.Params)
+	if err != nil {
+		var rpcErr *JSONRPCError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &JSONRPCError{Code: jsonrpcServerError, Message: err.Error()}
+		}
+		log.Printf("JSON-RPC %s failed: %s", *req.Method, rpcErr.Message)
+		return reply(nil, rpcErr)
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return reply(nil, &JSONRPCError{Code: jsonrpcInternalError, Message: "Internal error: " + err.Error()})
+	}
+	return reply(encoded, nil)
+}
+
+// callJSONRPC runs fn, turning a panic into an internal error.
+func callJSONRPC(ctx context.Context, fn JSONRPCFunc, params json.RawMessage) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("JSON-RPC method panicked: %v", r)
+			err = &JSONRPCError{Code: jsonrpcInternalError, Message: "Internal error"}
+		}
+	}()
+	return fn(ctx, params)
+}
+
+// validID reports whether id is absent or a string, number or null, the
+// only forms the spec allows.
+func validID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+	return false
+}
+
+func errorReply(id json.RawMessage, code int, message string) *jsonrpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &jsonrpcResponse{JSONRPC: "2.0", Error: &JSONRPCError{Code: code, Message: message}, ID: id}
+}
+
+func mustMarshal(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// jsonrpcChannel serves JSON-RPC messages arriving on one data channel.
+type jsonrpcChannel struct {
+	server  *JSONRPCServer
+	channel *framedChannel
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// newJSONRPCChannel serves messages arriving on dc until it closes or ctx,
+// the peer connection's context, is cancelled.
+func newJSONRPCChannel(ctx context.Context, dc *webrtc.DataChannel, server *JSONRPCServer) *jsonrpcChannel {
+	ctx, cancel := context.WithCancel(ctx)
+	jc := &jsonrpcChannel{
+		server:  server,
+		channel: newFramedChannel(dc, maxMessageSize),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	jc.channel.OnError(func(id uint32, err error) {
+		jc.send(mustMarshal(errorReply(nil, jsonrpcInvalidRequest, "Invalid Request: "+err.Error())))
+	})
+	jc.channel.OnMessage(jc.handleMessage)
+	return jc
+}
+
+// handleMessage serves each message on its own goroutine, like the REST
+// channel, so a slow call does not hold up the ones behind it.
+func (jc *jsonrpcChannel) handleMessage(msg webrtc.DataChannelMessage) {
+	go func() {
+		ctx, cancel := jc.ctx, context.CancelFunc(func() {})
+		if requestTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		}
+		defer cancel()
+
+		if reply := jc.server.ServeMessage(ctx, msg.Data); reply != nil && jc.ctx.Err() == nil {
+			jc.send(reply)
+		}
+	}()
+}
+
+func (jc *jsonrpcChannel) send(data []byte) {
+	if err := jc.channel.SendText(data); err != nil {
+		log.Printf("Failed to send JSON-RPC reply: %v", err)
+	}
+}
+
+func (jc *jsonrpcChannel) sendStats() sendQueueStats {
+	return jc.channel.stats()
+}
+
+func (jc *jsonrpcChannel) close() {
+	jc.cancel()
+	jc.channel.close()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestJSONRPCServer serves a few plain methods and routes backed by a
+// router of its own.
+func newTestJSONRPCServer(calls *atomic.Int32) *JSONRPCServer {
+	r := NewRouter()
+	r.Handle("GET", "/api/items", func(req *Request) RestAPIResponse {
+		return jsonResponse(http.StatusOK, map[string]string{"limit": req.Query.Get("limit")})
+	})
+	r.Handle("POST", "/api/items", func(req *Request) RestAPIResponse {
+		return jsonResponse(http.StatusCreated, req.Body)
+	})
+	r.Handle("GET", "/api/items/{id}", func(req *Request) RestAPIResponse {
+		switch req.Param("id") {
+		case "bad":
+			return errorResponse(http.StatusBadRequest, "id must be a number")
+		case "gone":
+			return errorResponse(http.StatusNotFound, "Item not found")
+		}
+		return jsonResponse(http.StatusOK, map[string]string{"id": req.Param("id")})
+	})
+
+	s := NewJSONRPCServer(r.Serve)
+	s.HandleRoute("items.list", "GET", "/api/items")
+	s.HandleRoute("items.create", "POST", "/api/items")
+	s.HandleRoute("items.get", "GET", "/api/items/{id}")
+	s.Handle("echo", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		calls.Add(1)
+		return params, nil
+	})
+	s.Handle("sleep", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var ms []int
+		if err := json.Unmarshal(params, &ms); err != nil || len(ms) != 1 {
+			return nil, &JSONRPCError{Code: jsonrpcInvalidParams, Message: "Invalid params: want [milliseconds]"}
+		}
+		time.Sleep(time.Duration(ms[0]) * time.Millisecond)
+		return ms[0], nil
+	})
+	s.Handle("fail", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return nil, &JSONRPCError{Code: 42, Message: "Custom failure"}
+	})
+	s.Handle("error", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return nil, errors.New("plain failure")
+	})
+	s.Handle("panic", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		panic("boom")
+	})
+	s.Handle("unencodable", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return func() {}, nil
+	})
+	return s
+}
+
+// testReply is a decoded response; Result stays raw so it can be compared
+// as JSON.
+type testReply struct {
+	Result json.RawMessage `json:"result"`
+	Error  *JSONRPCError   `json:"error"`
+	ID     json.RawMessage `json:"id"`
+}
+
+func TestJSONRPCErrorCodes(t *testing.T) {
+	s := newTestJSONRPCServer(new(atomic.Int32))
+	tests := []struct {
+		name       string
+		message    string
+		wantResult string
+		wantCode   int
+		wantID     string
+	}{
+		{"result", `{"jsonrpc":"2.0","method":"echo","params":[1,2],"id":1}`, `[1,2]`, 0, `1`},
+		{"string id", `{"jsonrpc":"2.0","method":"echo","params":{"a":1},"id":"x"}`, `{"a":1}`, 0, `"x"`},
+		{"parse error", `{"jsonrpc":"2.0","method":`, "", jsonrpcParseError, `null`},
+		{"wrong version", `{"jsonrpc":"1.0","method":"echo","id":1}`, "", jsonrpcInvalidRequest, `1`},
+		{"missing method", `{"jsonrpc":"2.0","id":1}`, "", jsonrpcInvalidRequest, `1`},
+		{"object id", `{"jsonrpc":"2.0","method":"echo","id":{}}`, "", jsonrpcInvalidRequest, `null`},
+		{"not an object", `1`, "", jsonrpcInvalidRequest, `null`},
+		{"empty batch", `[]`, "", jsonrpcInvalidRequest, `null`},
+		{"method not found", `{"jsonrpc":"2.0","method":"nope","id":1}`, "", jsonrpcMethodNotFound, `1`},
+		{"scalar params", `{"jsonrpc":"2.0","method":"echo","params":3,"id":1}`, "", jsonrpcInvalidParams, `1`},
+		{"method's own code", `{"jsonrpc":"2.0","method":"fail","id":1}`, "", 42, `1`},
+		{"plain error", `{"jsonrpc":"2.0","method":"error","id":1}`, "", jsonrpcServerError, `1`},
+		{"panic", `{"jsonrpc":"2.0","method":"panic","id":1}`, "", jsonrpcInternalError, `1`},
+		{"unencodable result", `{"jsonrpc":"2.0","method":"unencodable","id":1}`, "", jsonrpcInternalError, `1`},
+		{"route result", `{"jsonrpc":"2.0","method":"items.get","params":{"id":7},"id":1}`, `{"id":"7"}`, 0, `1`},
+		{"route query", `{"jsonrpc":"2.0","method":"items.list","params":{"limit":5},"id":1}`, `{"limit":"5"}`, 0, `1`},
+		{"route body", `{"jsonrpc":"2.0","method":"items.create","params":{"name":"a"},"id":1}`, `{"name":"a"}`, 0, `1`},
+		{"route 400", `{"jsonrpc":"2.0","method":"items.get","params":{"id":"bad"},"id":1}`, "", jsonrpcInvalidParams, `1`},
+		{"route 404", `{"jsonrpc":"2.0","method":"items.get","params":{"id":"gone"},"id":1}`, "", jsonrpcServerError, `1`},
+		{"route missing parameter", `{"jsonrpc":"2.0","method":"items.get","params":{},"id":1}`, "", jsonrpcInvalidParams, `1`},
+		{"route array params", `{"jsonrpc":"2.0","method":"items.get","params":[7],"id":1}`, "", jsonrpcInvalidParams, `1`},
+		{"batch too large", "[" + strings.Repeat(`{"jsonrpc":"2.0","method":"echo"},`, maxBatchSize) + "1]", "", jsonrpcInvalidRequest, `null`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := s.ServeMessage(context.Background(), []byte(tt.message))
+			var reply testReply
+			if err := json.Unmarshal(data, &reply); err != nil {
+				t.Fatalf("reply %s: %v", data, err)
+			}
+			if string(reply.ID) != tt.wantID {
+				t.Errorf("id = %s, want %s", reply.ID, tt.wantID)
+			}
+			if tt.wantCode == 0 {
+				if reply.Error != nil {
+					t.Fatalf("error = %+v, want result %s", reply.Error, tt.wantResult)
+				}
+				if !jsonEqual(reply.Result, []byte(tt.wantResult)) {
+					t.Fatalf("result = %s, want %s", reply.Result, tt.wantResult)
+				}
+				return
+			}
+			if reply.Error == nil || reply.Error.Code != tt.wantCode {
+				t.Fatalf("reply = %s, want error code %d", data, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestJSONRPCNotifications(t *testing.T) {
+	var calls atomic.Int32
+	s := newTestJSONRPCServer(&calls)
+	tests := []struct {
+		name      string
+		message   string
+		wantCalls int32
+	}{
+		{"notification", `{"jsonrpc":"2.0","method":"echo","params":[1]}`, 1},
+		{"unknown method", `{"jsonrpc":"2.0","method":"nope"}`, 0},
+		{"failing method", `{"jsonrpc":"2.0","method":"error"}`, 0},
+		{"panicking method", `{"jsonrpc":"2.0","method":"panic"}`, 0},
+		{"bad params", `{"jsonrpc":"2.0","method":"echo","params":3}`, 0},
+		{"batch of notifications", `[{"jsonrpc":"2.0","method":"echo"},{"jsonrpc":"2.0","method":"echo"}]`, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls.Store(0)
+			if reply := s.ServeMessage(context.Background(), []byte(tt.message)); reply != nil {
+				t.Fatalf("got reply %s to notifications", reply)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Fatalf("method ran %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestJSONRPCBatch(t *testing.T) {
+	s := newTestJSONRPCServer(new(atomic.Int32))
+	message := `[
+		{"jsonrpc":"2.0","method":"sleep","params":[50],"id":"slow"},
+		{"jsonrpc":"2.0","method":"echo","params":[1]},
+		{"jsonrpc":"2.0","method":"sleep","params":[0],"id":"fast"},
+		{"jsonrpc":"2.0","method":"nope","id":"missing"},
+		1
+	]`
+	start := time.Now()
+	data := s.ServeMessage(context.Background(), []byte(message))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("batch took %v", elapsed)
+	}
+
+	var replies []testReply
+	if err := json.Unmarshal(data, &replies); err != nil {
+		t.Fatalf("reply %s: %v", data, err)
+	}
+	var ids []string
+	var codes []int
+	for _, reply := range replies {
+		ids = append(ids, string(reply.ID))
+		code := 0
+		if reply.Error != nil {
+			code = reply.Error.Code
+		}
+		codes = append(codes, code)
+	}
+	// The notification gets no reply; the others keep the batch's order
+	wantIDs := []string{`"slow"`, `"fast"`, `"missing"`, `null`}
+	wantCodes := []int{0, 0, jsonrpcMethodNotFound, jsonrpcInvalidRequest}
+	if !reflect.DeepEqual(ids, wantIDs) || !reflect.DeepEqual(codes, wantCodes) {
+		t.Fatalf("ids %v codes %v, want %v %v", ids, codes, wantIDs, wantCodes)
+	}
+}
+
+func TestJSONRPCBatchRateLimit(t *testing.T) {
+	var calls atomic.Int32
+	s := newTestJSONRPCServer(&calls)
+	client := &Client{limiter: newRateLimiter(&RateLimitConfig{Rate: 0.001, Burst: 2}, func() {})}
+	ctx := withClient(context.Background(), client)
+	batch := []byte(`[{"jsonrpc":"2.0","method":"nope","id":1},{"jsonrpc":"2.0","method":"echo","params":[1]}]`)
+
+	// The batch and its one call use up the burst
+	if reply := s.ServeMessage(ctx, batch); reply == nil {
+		t.Fatal("first batch not answered")
+	}
+	var reply testReply
+	data := s.ServeMessage(ctx, batch)
+	if err := json.Unmarshal(data, &reply); err != nil {
+		t.Fatalf("reply %s: %v", data, err)
+	}
+	if reply.Error == nil || reply.Error.Code != jsonrpcServerError || string(reply.ID) != "null" {
+		t.Fatalf("reply = %s, want a rate limit error", data)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("echo ran %d times, want 1", got)
+	}
+}
+
+// jsonEqual compares two JSON documents by value.
+func jsonEqual(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/json"
 	"encoding/pem"
+	"flag"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"log"
 	"math/big"
 	"net"
@@ -22,6 +27,8 @@ import (
 	"github.com/pion/interceptor/pkg/intervalpli"
 	"github.com/pion/interceptor/pkg/nack"
 	"github.com/pion/webrtc/v4"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 var upgrader = websocket.Upgrader{
@@ -30,24 +37,53 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// Client is one signaling session. Every data channel it opens is served
+// and tracked separately in channels; ctx ends with the session.
 type Client struct {
-	conn       *websocket.Conn
-	peerConn   *webrtc.PeerConnection
-	dataChannel *webrtc.DataChannel
-	mu         sync.Mutex
+	id       string
+	conn     *websocket.Conn
+	peerConn *webrtc.PeerConnection
+	ctx      context.Context
+	limiter  *rateLimiter
+	mu       sync.Mutex
+	channels map[*webrtc.DataChannel]channelService
 }
 
+// RestAPIMessage is a REST-style request carried over the data channel.
+// ID is chosen by the client and echoed in the matching RestAPIResponse so
+// that several requests can be in flight on the same channel at once.
+//
+// A request with Binary set carries no inline Body; its BodyLength bytes
+// follow in binary body frames and are handed to the handler as RawBody.
+// Timeout, in milliseconds, overrides the server's default request timeout.
+// In a batch, a request with Ordered set waits for the ones before it.
 type RestAPIMessage struct {
-	Method   string            `json:"method"`
-	Endpoint string            `json:"endpoint"`
-	Headers  map[string]string `json:"headers"`
-	Body     interface{}       `json:"body"`
+	ID         string      `json:"id,omitempty"`
+	Method     string      `json:"method"`
+	Endpoint   string      `json:"endpoint"`
+	Headers    Header      `json:"headers"`
+	Body       interface{} `json:"body"`
+	Binary     bool        `json:"binary,omitempty"`
+	BodyLength int         `json:"bodyLength,omitempty"`
+	Timeout    int64       `json:"timeout,omitempty"`
+	Ordered    bool        `json:"ordered,omitempty"`
+	RawBody    []byte      `json:"-"`
 }
 
+// RestAPIResponse answers a RestAPIMessage. Setting RawBody sends the body
+// as raw bytes after the envelope instead of encoding Body as JSON. Setting
+// Streamer turns the response into a stream: the envelope goes out first and
+// Streamer then emits the body as a sequence of StreamMessages.
 type RestAPIResponse struct {
-	Status  int         `json:"status"`
-	Headers map[string]string `json:"headers"`
-	Body    interface{} `json:"body"`
+	ID         string      `json:"id,omitempty"`
+	Status     int         `json:"status"`
+	Headers    Header      `json:"headers"`
+	Body       interface{} `json:"body"`
+	Binary     bool        `json:"binary,omitempty"`
+	BodyLength int         `json:"bodyLength,omitempty"`
+	Stream     string      `json:"stream,omitempty"`
+	RawBody    []byte      `json:"-"`
+	Streamer   StreamFunc  `json:"-"`
 }
 
 // filteredWriter filters out harmless TLS handshake error messages
@@ -64,6 +100,61 @@ func (w *filteredWriter) Write(p []byte) (n int, err error) {
 }
 
 func main() {
+	flag.Var(upstreams, "upstream", "forward endpoints under a prefix to an upstream HTTP service, as /prefix=http://host:port (repeatable)")
+	flag.IntVar(&maxMessageSize, "max-message-size", maxMessageSize, "largest data channel message, in bytes, accepted or sent after reassembly")
+	flag.DurationVar(&upstreams.client.Timeout, "upstream-timeout", 10*time.Second, "timeout for requests forwarded to an upstream service")
+	flag.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "default timeout for data channel requests that do not set their own (0 disables)")
+	flag.IntVar(&compressThreshold, "compress-threshold", compressThreshold, "smallest response body, in bytes, compressed for clients that send Accept-Encoding")
+	flag.StringVar(&uploadDir, "upload-dir", uploadDir, "directory that files uploaded on the file-transfer data channel are stored in")
+	flag.Int64Var(&maxUploadSize, "max-upload-size", maxUploadSize, "largest file, in bytes, accepted on the file-transfer data channel")
+	flag.IntVar(&sendHighWater, "send-high-water", sendHighWater, "bytes a data channel may buffer before its send queue waits for it to drain")
+	flag.IntVar(&sendQueueDepth, "send-queue-depth", sendQueueDepth, "messages a data channel's send queue holds before senders have to wait")
+	flag.DurationVar(&serverTelemetryInterval, "server-telemetry", 0, "report server metrics to each client on an unordered telemetry data channel at this interval (0 disables)")
+	flag.UintVar(&serverTelemetryRetransmits, "server-telemetry-retransmits", 0, "maxRetransmits of the server's telemetry data channel")
+	flag.DurationVar(&serverTelemetryLifetime, "server-telemetry-lifetime", 0, "maxPacketLifeTime of the server's telemetry data channel, used instead of -server-telemetry-retransmits when set")
+	flag.DurationVar(&drainTimeout, "drain-timeout", drainTimeout, "how long sessions may keep running after SIGTERM before the server closes them and exits")
+	flag.DurationVar(&idempotencyWindow, "idempotency-window", idempotencyWindow, "how long the response to a request with an Idempotency-Key is replayed to retries (0 disables)")
+	flag.IntVar(&idempotencyCacheSize, "idempotency-cache-size", idempotencyCacheSize, "bytes of responses kept for replay to retried requests; the least recently used go first")
+	rateLimitsFile := flag.String("rate-limits", "", "load per-session and per-endpoint REST rate limits from this JSON file")
+	usersFile := flag.String("users-file", "", "persist /api/users to this JSON file instead of keeping them in memory")
+	openapiFile := flag.String("openapi", "", "generate the REST routes from this OpenAPI 3 document instead of the built-in one")
+	flag.Parse()
+
+	spec, err := loadOpenAPI(*openapiFile)
+	if err != nil {
+		log.Fatal("Failed to load OpenAPI document:", err)
+	}
+	apiSpec = spec
+	routeOperations(router, apiSpec, operations)
+	registerMiddleware()
+	restHandler = chainMiddleware(serveEndpoint, requestMiddleware...)
+
+	if *rateLimitsFile != "" {
+		limits, err := loadRateLimits(*rateLimitsFile)
+		if err != nil {
+			log.Fatal("Failed to load rate limits:", err)
+		}
+		rateLimits = limits
+	}
+	seed := true
+	if *usersFile != "" {
+		store, err := NewFileUserStore(*usersFile)
+		if err != nil {
+			log.Fatal("Failed to open users file:", err)
+		}
+		userStore = store
+		// An existing file is kept as it is, even with every user deleted
+		seed = !store.existed
+	}
+	if seed {
+		if err := seedUsers(userStore); err != nil {
+			log.Fatal("Failed to seed users:", err)
+		}
+	}
+
+	// Served to clients that open a "grpc" data channel
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+
 	// Generate self-signed certificate for HTTPS
 	if err := generateCertificate(); err != nil {
 		log.Fatal("Failed to generate certificate:", err)
@@ -112,9 +203,26 @@ func main() {
 
 	// HTTP handlers
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			http.Error(w, "Server is draining", http.StatusServiceUnavailable)
+			return
+		}
 		handleWebSocket(w, r, api)
 	})
 
+	// Health checks answer over HTTPS too, for load balancers
+	http.Handle("/api/health", routerHandler(router))
+	http.Handle("/api/health/ready", routerHandler(router))
+	http.Handle("/api/openapi.json", routerHandler(router))
+
+	// Standard http.Handlers are served over HTTPS and the data channel alike
+	apiMux := http.NewServeMux()
+	apiMux.HandleFunc("/api/echo", echoHandler)
+	apiMux.HandleFunc("/api/echo/", echoHandler)
+	mountHandler("/api/echo", apiMux)
+	http.Handle("/api/echo", apiMux)
+	http.Handle("/api/echo/", apiMux)
+
 	http.HandleFunc("/ws-test", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		w.Write([]byte("WebSocket endpoint is working. Certificate accepted for WSS connections."))
@@ -152,7 +260,11 @@ func main() {
 		ErrorLog: log.New(&filteredWriter{}, "", log.LstdFlags),
 	}
 	
-	log.Fatal(server.ListenAndServeTLS("server.crt", "server.key"))
+	go drainOnSignal(server)
+	if err := server.ListenAndServeTLS("server.crt", "server.key"); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	log.Println("Server stopped")
 }
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request, api *webrtc.API) {
@@ -163,7 +275,22 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, api *webrtc.API) {
 	}
 	defer conn.Close()
 
-	client := &Client{conn: conn}
+	// Requests still running when the session ends are cancelled through ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &Client{
+		id:       rand.Text()[:8],
+		conn:     conn,
+		channels: make(map[*webrtc.DataChannel]channelService),
+	}
+	client.ctx = withClient(ctx, client)
+	sessions.add(client)
+	defer sessions.remove(client)
+	client.limiter = newRateLimiter(rateLimits, func() {
+		client.closeSession("kept exceeding its rate limit")
+	})
+	defer client.closeChannels()
 
 	// Create a new RTCPeerConnection
 	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
@@ -207,9 +334,17 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, api *webrtc.API) {
 		}
 	})
 
-	// Handle connection state changes
+	// Handle connection state changes; the server's own telemetry channel
+	// is opened once the connection is up
+	var openTelemetry sync.Once
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		log.Printf("Peer connection state changed: %s", state.String())
+		if state == webrtc.PeerConnectionStateConnected && serverTelemetryInterval > 0 {
+			openTelemetry.Do(client.openTelemetryChannel)
+		}
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			cancel()
+		}
 	})
 
 	// Handle ICE connection state changes  
@@ -217,57 +352,11 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, api *webrtc.API) {
 		log.Printf("ICE connection state changed: %s", state.String())
 	})
 
-	// Handle incoming data channel from client
+	// Handle incoming data channel from client; each label is served by
+	// its own handler
 	peerConnection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
 		log.Printf("📥 Received data channel from client: %s", dataChannel.Label())
-		client.dataChannel = dataChannel
-
-		dataChannel.OnOpen(func() {
-			log.Println("✅ Data channel opened on server side")
-			
-			// Send a welcome REST API response
-			welcome := RestAPIResponse{
-				Status: 200,
-				Headers: map[string]string{"Content-Type": "application/json"},
-				Body:   map[string]string{"message": "WebRTC REST API Server Ready"},
-			}
-			if data, err := json.Marshal(welcome); err == nil {
-				log.Println("📤 Sending welcome message to data channel")
-				if sendErr := dataChannel.Send(data); sendErr != nil {
-					log.Printf("Failed to send welcome message: %v", sendErr)
-				}
-			}
-		})
-
-		dataChannel.OnClose(func() {
-			log.Println("❌ Data channel closed on server side")
-			client.dataChannel = nil
-		})
-
-		dataChannel.OnError(func(err error) {
-			log.Printf("⚠️ Data channel error on server side: %v", err)
-		})
-
-		dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
-			log.Printf("📥 Received data channel message: %s", string(msg.Data))
-			
-			// Parse REST API request
-			var apiRequest RestAPIMessage
-			if err := json.Unmarshal(msg.Data, &apiRequest); err != nil {
-				log.Println("Failed to parse API request:", err)
-				return
-			}
-
-			// Handle the REST API request
-			response := handleRestAPIRequest(apiRequest)
-			
-			// Send response back
-			if data, err := json.Marshal(response); err == nil {
-				if sendErr := dataChannel.Send(data); sendErr != nil {
-					log.Printf("Failed to send API response: %v", sendErr)
-				}
-			}
-		})
+		client.serveDataChannel(dataChannel)
 	})
 
 	client.peerConn = peerConnection
@@ -363,60 +452,139 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, api *webrtc.API) {
 	}
 }
 
-func handleRestAPIRequest(request RestAPIMessage) RestAPIResponse {
-	log.Printf("Handling REST API: %s %s", request.Method, request.Endpoint)
-	
-	// Simulate different REST endpoints
-	switch request.Endpoint {
-	case "/api/users":
-		if request.Method == "GET" {
-			return RestAPIResponse{
-				Status: 200,
-				Headers: map[string]string{"Content-Type": "application/json"},
-				Body: []map[string]interface{}{
-					{"id": 1, "name": "John Doe", "email": "john@example.com"},
-					{"id": 2, "name": "Jane Smith", "email": "jane@example.com"},
-				},
-			}
-		} else if request.Method == "POST" {
-			return RestAPIResponse{
-				Status: 201,
-				Headers: map[string]string{"Content-Type": "application/json"},
-				Body: map[string]interface{}{
-					"id": 3,
-					"message": "User created successfully",
-					"data": request.Body,
-				},
-			}
-		}
-	case "/api/health":
-		return RestAPIResponse{
-			Status: 200,
-			Headers: map[string]string{"Content-Type": "application/json"},
-			Body: map[string]interface{}{
-				"status": "healthy",
-				"timestamp": "2025-09-18T12:00:00Z",
-				"version": "1.0.0",
-			},
-		}
-	default:
-		return RestAPIResponse{
-			Status: 404,
-			Headers: map[string]string{"Content-Type": "application/json"},
-			Body: map[string]string{
-				"error": "Endpoint not found",
-				"endpoint": request.Endpoint,
-			},
-		}
+// handleRestAPIRequest answers request. ctx is cancelled when the request
+// times out, is cancelled by the client, or its session ends.
+func handleRestAPIRequest(ctx context.Context, request RestAPIMessage) RestAPIResponse {
+	return restHandler(newRequest(ctx, request))
+}
+
+// restHandler serves every data channel request. main wraps serveEndpoint
+// in the registered middleware before the server starts.
+var restHandler Handler = serveEndpoint
+
+// registerMiddleware adds the middleware that every data channel request
+// passes through, outermost first.
+func registerMiddleware() {
+	useMiddleware(
+		logRequests,
+		recoverPanics,
+		replayIdempotent,
+		timeRequests,
+	)
+}
+
+// serveEndpoint hands req to whatever serves its endpoint.
+func serveEndpoint(req *Request) RestAPIResponse {
+	ctx, request := req.Context(), req.RestAPIMessage
+
+	// Endpoints mapped to an upstream service are forwarded as real HTTP calls
+	if route := upstreams.match(request.Endpoint); route != nil {
+		return upstreams.forward(ctx, route, request)
+	}
+
+	// Endpoints backed by a mounted http.Handler
+	if h := matchHandler(request.Endpoint); h != nil {
+		return serveHTTPHandler(ctx, h, request)
 	}
 	
+	return router.Serve(ctx, request)
+}
+
+// router holds the built-in data channel endpoints. main fills it from the
+// OpenAPI document.
+var router = NewRouter()
+
+// operations implements the OpenAPI document's operations, by operationId.
+var operations = map[string]Handler{
+	"listUsers":   listUsers,
+	"createUser":  createUser,
+	"getUser":     getUser,
+	"replaceUser": replaceUser,
+	"updateUser":  patchUser,
+	"deleteUser":  deleteUser,
+	"getImage":    getImage,
+	"getProgress": getProgress,
+	"getSlow":     getSlow,
+	"getHealth":   getHealth,
+	"getReady":    getReady,
+	"getOpenAPI":  getOpenAPI,
+}
+
+// dataChannels maps the labels of client-opened data channels to the
+// services behind them.
+var dataChannels = newDataChannelRegistry()
+
+func newDataChannelRegistry() *ChannelRegistry {
+	r := NewChannelRegistry()
+	r.Handle(restLabel, serveRESTChannel)
+	r.Handle(grpcLabel, func(client *Client, dc *webrtc.DataChannel) channelService {
+		return newGRPCChannel(client.ctx, dc, grpcServer)
+	})
+	r.Handle(jsonrpcLabel, func(client *Client, dc *webrtc.DataChannel) channelService {
+		return newJSONRPCChannel(client.ctx, dc, rpcServer)
+	})
+	r.Handle(chatLabel, serveChatChannel)
+	r.HandleUnreliable(telemetryLabel, serveTelemetryChannel)
+	r.Handle(fileTransferLabel, serveFileTransferChannel)
+	return r
+}
+
+// rpcServer serves the "jsonrpc" data channel with the same handlers.
+var rpcServer = newAPIJSONRPCServer()
+
+func newAPIJSONRPCServer() *JSONRPCServer {
+	s := NewJSONRPCServer(handleRestAPIRequest)
+	registerUserMethods(s)
+	s.HandleRoute("health", "GET", "/api/health")
+	return s
+}
+
+func getImage(req *Request) RestAPIResponse {
+	// Binary responses travel as raw bytes, not base64 inside JSON
 	return RestAPIResponse{
-		Status: 405,
-		Headers: map[string]string{"Content-Type": "application/json"},
-		Body: map[string]string{"error": "Method not allowed"},
+		Status:  200,
+		Headers: Header{"Content-Type": {"image/png"}},
+		RawBody: gradientPNG(128, 128),
 	}
 }
 
+func getProgress(req *Request) RestAPIResponse {
+	return RestAPIResponse{
+		Status:   200,
+		Headers:  Header{"Content-Type": {"application/json"}},
+		Streamer: progressStream,
+	}
+}
+
+// getSlow answers after ?delay= milliseconds (default 5000), unless the
+// request is cancelled or times out first.
+func getSlow(req *Request) RestAPIResponse {
+	delay, err := queryInt(req, "delay", 5000)
+	if err != nil {
+		return errorResponse(400, err.Error())
+	}
+	select {
+	case <-time.After(time.Duration(delay) * time.Millisecond):
+		return jsonResponse(200, map[string]int{"delayed": delay})
+	case <-req.Context().Done():
+		log.Printf("Slow request stopped early: %v", context.Cause(req.Context()))
+		return errorResponse(503, "Request abandoned")
+	}
+}
+
+// gradientPNG renders a small test image for the binary response demo.
+func gradientPNG(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 160, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
 func handleOffer(client *Client, msg map[string]interface{}) {
 	offer := webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
@@ -593,6 +761,7 @@ const htmlContent = `<!DOCTYPE html>
         <button onclick="stopConnection()">Stop Connection</button>
         <button onclick="testWebSocket()">Test WebSocket Connection</button>
         <div id="connectionStatus" class="status">Ready to connect</div>
+        <div id="serverTelemetry"></div>
         
         <div style="background: #fff3cd; border: 1px solid #ffeaa7; padding: 10px; margin: 10px 0; border-radius: 4px;">
             <strong>📋 Certificate Setup:</strong><br>
@@ -615,7 +784,43 @@ const htmlContent = `<!DOCTYPE html>
         <h3>REST API over DataChannel</h3>
         <button onclick="apiCall('GET', '/api/health')">GET /api/health</button>
         <button onclick="apiCall('GET', '/api/users')">GET /api/users</button>
+        <button onclick="apiCall('GET', '/api/users?limit=1')">GET /api/users?limit=1</button>
+        <button onclick="apiCall('GET', '/api/users/2')">GET /api/users/2</button>
         <button onclick="apiCall('POST', '/api/users')">POST /api/users</button>
+        <div>
+            User <input id="userId" size="3" value="1">
+            name <input id="userName" value="John Updated">
+            email <input id="userEmail" value="john@example.com">
+            <button onclick="userCall('PUT')">PUT</button>
+            <button onclick="userCall('PATCH')">PATCH</button>
+            <button onclick="userCall('DELETE')">DELETE</button>
+        </div>
+        <button onclick="apiCall('GET', '/api/echo?source=webrtc')">GET /api/echo</button>
+        <button onclick="apiCall('GET', '/api/image')">GET /api/image</button>
+        <button onclick="apiCall('GET', '/api/progress')">GET /api/progress (stream)</button>
+        <button onclick="apiCall('GET', '/api/slow?delay=5000', null, null, { timeout: 2000 })">GET /api/slow (2s timeout)</button>
+        <button onclick="cancelLastRequest()">Cancel last request</button>
+        <button onclick="apiCall('SUBSCRIBE', '/api/users')">SUBSCRIBE /api/users</button>
+        <button onclick="apiCall('UNSUBSCRIBE', '/api/users')">UNSUBSCRIBE /api/users</button>
+        <button onclick="apiCall('POST', '/api/echo', randomBytes(100 * 1024))">POST /api/echo (100 KiB binary)</button>
+        <button onclick="apiBatch([{ method: 'GET', endpoint: '/api/health' }, { method: 'GET', endpoint: '/api/users' }, { method: 'GET', endpoint: '/api/users/999' }, { method: 'GET', endpoint: '/api/image' }])">Batch of 4 requests</button>
+        <div>
+            gRPC: <button onclick="grpcHealthCheck()">Health/Check</button>
+            <button onclick="grpcHealthWatch()">Health/Watch (stream)</button>
+        </div>
+        <div>
+            JSON-RPC: <button onclick="jsonRpcCall('users.list', { limit: 1 })">users.list</button>
+            <button onclick="jsonRpcCall('users.get', { id: 2 })">users.get</button>
+            <button onclick="jsonRpcBatch()">batch</button>
+        </div>
+        <div>
+            Chat: <input type="text" id="chatText" placeholder="Say something">
+            <button onclick="sendChat()">Send</button>
+        </div>
+        <div>
+            Upload: <input type="file" id="uploadFile">
+            <button onclick="uploadFile()">Upload</button>
+        </div>
         
         <div id="apiResponses"></div>
     </div>
@@ -625,6 +830,69 @@ const htmlContent = `<!DOCTYPE html>
         let dataChannel = null;
         let ws = null;
 
+        // Requests waiting for a response, keyed by request ID. The server
+        // handles requests concurrently, so responses can arrive in any order.
+        let nextRequestId = 1;
+        const pendingRequests = new Map();
+
+        // Framing layer: messages larger than FRAGMENT_SIZE travel as binary
+        // fragment frames and are reassembled on the other side. Must match
+        // the constants in framing.go.
+        const FRAGMENT_SIZE = 16 * 1024;
+        const MAX_MESSAGE_SIZE = 16 * 1024 * 1024;
+        const REASSEMBLY_TIMEOUT_MS = 30000;
+        const FRAME_FRAGMENT = 0x01;
+        const FRAGMENT_HEADER_SIZE = 14;
+        const FRAGMENT_KIND_TEXT = 0;
+        let nextFragmentId = 1;
+        const partialMessages = new Map();
+        // Fragmented requests by fragment message id, so server-side
+        // reassembly errors can be tied back to the request
+        const sentFragments = new Map();
+
+        // Binary bodies travel as raw bytes in body frames after their JSON
+        // envelope, instead of base64 inside it. Must match restchannel.go.
+        const FRAME_BODY = 0x02;
+        const BODY_CHUNK_SIZE = FRAGMENT_SIZE - 2 - 255;
+        const pendingBodies = new Map();
+
+        // Large bodies are compressed when both sides support it. The server
+        // lists the request encodings it accepts in its welcome message.
+        // Must match compressThreshold in compression.go.
+        const COMPRESS_THRESHOLD = 1024;
+        const ACCEPT_ENCODING = typeof DecompressionStream !== 'undefined' ? 'gzip, deflate' : null;
+        let serverEncodings = [];
+
+        // gRPC calls travel on their own "grpc" data channel as frames of
+        // type(1) | call id(4) | payload. Must match grpc.go.
+        const GRPC_FRAME_HEADERS = 0x10;
+        const GRPC_FRAME_MESSAGE = 0x11;
+        const GRPC_FRAME_TRAILERS = 0x12;
+        const GRPC_FRAME_CANCEL = 0x13;
+        const GRPC_CODES = ['OK', 'CANCELLED', 'UNKNOWN', 'INVALID_ARGUMENT', 'DEADLINE_EXCEEDED', 'NOT_FOUND',
+            'ALREADY_EXISTS', 'PERMISSION_DENIED', 'RESOURCE_EXHAUSTED', 'FAILED_PRECONDITION', 'ABORTED',
+            'OUT_OF_RANGE', 'UNIMPLEMENTED', 'INTERNAL', 'UNAVAILABLE', 'DATA_LOSS', 'UNAUTHENTICATED'];
+        let grpcChannel = null;
+        let nextCallId = 1;
+        const grpcCalls = new Map();
+
+        // JSON-RPC 2.0 messages use the "jsonrpc" data channel
+        let jsonRpcChannel = null;
+        let nextJsonRpcId = 1;
+
+        // Chat messages and file uploads have their own data channels
+        let chatChannel = null;
+        let fileChannel = null;
+        const UPLOAD_CHUNK_SIZE = 16 * 1024;
+
+        // Connection metrics go out on an unordered, unreliable channel,
+        // numbered so the server can drop readings that arrive late
+        let telemetryChannel = null;
+        let telemetryTimer = null;
+        let telemetrySeq = 0;
+        const TELEMETRY_INTERVAL = 2000;
+        const serverMetrics = new Map();
+
         function updateConnectionStatus(status) {
             const statusElement = document.getElementById('connectionStatus');
             if (statusElement) {
@@ -706,6 +974,7 @@ const htmlContent = `<!DOCTYPE html>
                 dataChannel = pc.createDataChannel('rest-api', {
                     ordered: true
                 });
+                dataChannel.binaryType = 'arraybuffer';
 
                 dataChannel.onopen = () => {
                     console.log('✅ Data channel opened on client side');
@@ -716,6 +985,15 @@ const htmlContent = `<!DOCTYPE html>
                     console.log('❌ Data channel closed on client side');
                     updateConnectionStatus('Data channel disconnected');
                     dataChannel = null;
+
+                    // Nothing will answer requests still in flight
+                    pendingRequests.forEach(pending => pending.reject(new Error('Data channel closed')));
+                    pendingRequests.clear();
+                    partialMessages.forEach(partial => clearTimeout(partial.timer));
+                    partialMessages.clear();
+                    sentFragments.clear();
+                    pendingBodies.clear();
+                    serverEncodings = [];
                 };
                 
                 dataChannel.onerror = (error) => {
@@ -728,6 +1006,49 @@ const htmlContent = `<!DOCTYPE html>
                     handleDataChannelMessage(event);
                 };
 
+                grpcChannel = pc.createDataChannel('grpc', { ordered: true });
+                grpcChannel.binaryType = 'arraybuffer';
+                grpcChannel.onmessage = handleGrpcFrame;
+                jsonRpcChannel = pc.createDataChannel('jsonrpc', { ordered: true });
+                jsonRpcChannel.onmessage = event => {
+                    if (typeof event.data !== 'string') {
+                        console.warn('⚠️ Fragmented JSON-RPC replies are not supported by this client');
+                        return;
+                    }
+                    showJsonRpcReply(JSON.parse(event.data));
+                };
+                jsonRpcChannel.onclose = () => {
+                    jsonRpcChannel = null;
+                };
+                chatChannel = pc.createDataChannel('chat', { ordered: true });
+                chatChannel.onmessage = event => showChannelMessage('💬 Chat', JSON.parse(event.data));
+                chatChannel.onclose = () => {
+                    chatChannel = null;
+                };
+                fileChannel = pc.createDataChannel('file-transfer', { ordered: true });
+                fileChannel.bufferedAmountLowThreshold = 256 * 1024;
+                fileChannel.onmessage = event => showChannelMessage('📁 Upload', JSON.parse(event.data));
+                fileChannel.onclose = () => {
+                    fileChannel = null;
+                };
+                // Telemetry is fire and forget: a lost or late reading is
+                // not worth retransmitting
+                telemetryChannel = pc.createDataChannel('telemetry', { ordered: false, maxRetransmits: 0 });
+                telemetryChannel.onopen = () => {
+                    telemetryTimer = setInterval(reportTelemetry, TELEMETRY_INTERVAL);
+                };
+                telemetryChannel.onclose = () => {
+                    clearInterval(telemetryTimer);
+                    telemetryChannel = null;
+                };
+
+                grpcChannel.onclose = () => {
+                    console.log('❌ gRPC data channel closed on client side');
+                    grpcChannel = null;
+                    grpcCalls.forEach(call => call.reject(new Error('gRPC data channel closed')));
+                    grpcCalls.clear();
+                };
+
                 // Add local stream tracks
                 stream.getTracks().forEach(track => {
                     pc.addTrack(track, stream);
@@ -756,9 +1077,13 @@ const htmlContent = `<!DOCTYPE html>
                 };
 
                 // Handle data channel events (server will receive data channel from client)
+                // The only channel the server opens is its telemetry feed,
+                // when started with -server-telemetry
                 pc.ondatachannel = (event) => {
-                    console.log('🎉 Server created data channel, but we handle it on client side');
-                    // We don't need to handle server data channels since we create it on client side
+                    console.log('🎉 Server created data channel:', event.channel.label);
+                    if (event.channel.label === 'telemetry') {
+                        event.channel.onmessage = handleServerTelemetry;
+                    }
                 };
 
                 // Handle connection state changes
@@ -910,6 +1235,27 @@ const htmlContent = `<!DOCTYPE html>
                 dataChannel.close();
                 dataChannel = null;
             }
+            if (grpcChannel) {
+                grpcChannel.close();
+                grpcChannel = null;
+            }
+            if (jsonRpcChannel) {
+                jsonRpcChannel.close();
+                jsonRpcChannel = null;
+            }
+            if (chatChannel) {
+                chatChannel.close();
+                chatChannel = null;
+            }
+            if (fileChannel) {
+                fileChannel.close();
+                fileChannel = null;
+            }
+            if (telemetryChannel) {
+                clearInterval(telemetryTimer);
+                telemetryChannel.close();
+                telemetryChannel = null;
+            }
             if (pc) {
                 pc.close();
                 pc = null;
@@ -922,7 +1268,7 @@ const htmlContent = `<!DOCTYPE html>
             updateConnectionStatus('Disconnected');
         }
 
-        function apiCall(method, endpoint, body = null) {
+        function apiCall(method, endpoint, body = null, headers = null, options = {}) {
             console.log('🔍 API call attempt - checking data channel...');
             console.log('📊 DataChannel exists:', !!dataChannel);
             if (dataChannel) {
@@ -931,19 +1277,221 @@ const htmlContent = `<!DOCTYPE html>
             
             if (!dataChannel || dataChannel.readyState !== 'open') {
                 alert('Data channel not connected. Please start connection first and wait for "Ready for API calls" status.\n\nCurrent state: ' + (dataChannel ? dataChannel.readyState : 'null'));
-                return;
+                return Promise.reject(new Error('Data channel not connected'));
             }
 
-            console.log('📤 Making API call: ' + method + ' ' + endpoint);
+            const id = 'req-' + (nextRequestId++);
+            console.log('📤 Making API call ' + id + ': ' + method + ' ' + endpoint);
 
+            const binary = body instanceof ArrayBuffer || ArrayBuffer.isView(body);
             const request = {
+                id: id,
                 method: method,
                 endpoint: endpoint,
-                headers: { 'Content-Type': 'application/json' },
-                body: body || (method === 'POST' ? { name: 'New User', email: 'newuser@example.com' } : null)
+                headers: Object.assign({}, headers || { 'Content-Type': binary ? 'application/octet-stream' : 'application/json' }),
+                body: binary ? null : (body || (method === 'POST' ? { name: 'New User', email: 'newuser' + Date.now() + '@example.com' } : null))
             };
+            if (options.timeout) {
+                request.timeout = options.timeout;
+            }
+            if (ACCEPT_ENCODING && !request.headers['Accept-Encoding']) {
+                request.headers['Accept-Encoding'] = ACCEPT_ENCODING;
+            }
+            if (binary) {
+                body = ArrayBuffer.isView(body) ? new Uint8Array(body.buffer, body.byteOffset, body.byteLength) : new Uint8Array(body);
+                request.binary = true;
+                request.bodyLength = body.length;
+            }
+
+            return new Promise((resolve, reject) => {
+                pendingRequests.set(id, { method, endpoint, resolve, reject });
+                sendRequest(request, binary ? body : null).catch(error => {
+                    pendingRequests.delete(id);
+                    reject(error);
+                });
+            });
+        }
+
+        // Send a request envelope and its binary body, if any. Large JSON
+        // bodies are compressed and sent as binary bodies when the server
+        // accepts an encoding the browser can produce.
+        async function sendRequest(request, bytes) {
+            const encoding = typeof CompressionStream !== 'undefined' && ['gzip', 'deflate'].find(e => serverEncodings.includes(e));
+            if (!bytes && request.body !== null && encoding) {
+                const json = new TextEncoder().encode(JSON.stringify(request.body));
+                if (json.length >= COMPRESS_THRESHOLD) {
+                    bytes = await transformBytes(json, new CompressionStream(encoding));
+                    console.log('🗜️ Compressed ' + request.id + ' body with ' + encoding + ': ' + json.length + ' -> ' + bytes.length + ' bytes');
+                    request.headers['Content-Encoding'] = encoding;
+                    request.body = null;
+                    request.binary = true;
+                    request.bodyLength = bytes.length;
+                }
+            }
+            sendMessage(JSON.stringify(request), request.id);
+            if (bytes) {
+                sendBody(request.id, bytes);
+            }
+        }
+
+        // Run bytes through a CompressionStream or DecompressionStream
+        async function transformBytes(bytes, transform) {
+            const stream = new Blob([bytes]).stream().pipeThrough(transform);
+            return new Uint8Array(await new Response(stream).arrayBuffer());
+        }
+
+        // Send a text message, splitting it into fragment frames when it is
+        // too large for a single data channel message.
+        function sendMessage(text, requestId) {
+            const bytes = new TextEncoder().encode(text);
+            if (bytes.length <= FRAGMENT_SIZE) {
+                dataChannel.send(text);
+                return;
+            }
+            if (bytes.length > MAX_MESSAGE_SIZE) {
+                throw new Error('Message exceeds maximum size: ' + bytes.length + ' bytes');
+            }
+
+            const fragmentId = nextFragmentId++;
+            sentFragments.set(fragmentId, requestId);
+            console.log('📦 Sending ' + bytes.length + ' bytes as fragmented message ' + fragmentId);
+            for (let seq = 0, offset = 0; offset < bytes.length; seq++) {
+                const end = Math.min(offset + FRAGMENT_SIZE, bytes.length);
+                const frame = new Uint8Array(FRAGMENT_HEADER_SIZE + end - offset);
+                const view = new DataView(frame.buffer);
+                view.setUint8(0, FRAME_FRAGMENT);
+                view.setUint8(1, FRAGMENT_KIND_TEXT);
+                view.setUint32(2, fragmentId);
+                view.setUint32(6, seq);
+                view.setUint32(10, bytes.length);
+                frame.set(bytes.subarray(offset, end), FRAGMENT_HEADER_SIZE);
+                dataChannel.send(frame);
+                offset = end;
+            }
+        }
+
+        // Update or delete the user selected in the form
+        function userCall(method) {
+            const id = document.getElementById('userId').value;
+            const body = {};
+            const name = document.getElementById('userName').value;
+            const email = document.getElementById('userEmail').value;
+            if (method === 'PUT' || name) {
+                body.name = name;
+            }
+            if (method === 'PUT' || email) {
+                body.email = email;
+            }
+            return apiCall(method, '/api/users/' + encodeURIComponent(id), method === 'DELETE' ? null : body);
+        }
+
+        // Send several requests in one message. The server answers them all
+        // at once, with one response per request in the same order.
+        function apiBatch(requests) {
+            if (!dataChannel || dataChannel.readyState !== 'open') {
+                alert('Data channel not connected. Please start connection first and wait for "Ready for API calls" status.');
+                return Promise.reject(new Error('Data channel not connected'));
+            }
+            const batch = requests.map(request => Object.assign({ id: 'req-' + (nextRequestId++) }, request));
+            const responses = batch.map(request => new Promise((resolve, reject) => {
+                pendingRequests.set(request.id, { method: request.method, endpoint: request.endpoint, resolve, reject });
+            }));
+            console.log('📦 Sending batch of ' + batch.length + ' requests');
+            try {
+                sendMessage(JSON.stringify(batch), batch[0].id);
+            } catch (error) {
+                batch.forEach(request => {
+                    const pending = pendingRequests.get(request.id);
+                    pendingRequests.delete(request.id);
+                    pending.reject(error);
+                });
+            }
+            return Promise.all(responses);
+        }
+
+        // Send a binary request body as body frames tagged with the request ID
+        function sendBody(id, bytes) {
+            const idBytes = new TextEncoder().encode(id);
+            for (let offset = 0; offset < bytes.length; offset += BODY_CHUNK_SIZE) {
+                const chunk = bytes.subarray(offset, Math.min(offset + BODY_CHUNK_SIZE, bytes.length));
+                const frame = new Uint8Array(2 + idBytes.length + chunk.length);
+                frame[0] = FRAME_BODY;
+                frame[1] = idBytes.length;
+                frame.set(idBytes, 2);
+                frame.set(chunk, 2 + idBytes.length);
+                dataChannel.send(frame);
+            }
+        }
+
+        function randomBytes(length) {
+            const bytes = new Uint8Array(length);
+            for (let offset = 0; offset < length; offset += 65536) {
+                crypto.getRandomValues(bytes.subarray(offset, Math.min(offset + 65536, length)));
+            }
+            return bytes;
+        }
+
+        // Add a fragment frame to its message. Returns the message text once
+        // complete, or null while fragments are still outstanding.
+        function reassembleFragment(buffer) {
+            if (buffer.byteLength < FRAGMENT_HEADER_SIZE) {
+                reportFragmentError(0, 'malformed fragment frame');
+                return null;
+            }
+            const view = new DataView(buffer);
+            const kind = view.getUint8(1);
+            const id = view.getUint32(2);
+            const seq = view.getUint32(6);
+            const total = view.getUint32(10);
+            const payload = new Uint8Array(buffer, FRAGMENT_HEADER_SIZE);
+
+            let partial = partialMessages.get(id);
+            if (!partial) {
+                if (seq !== 0) {
+                    reportFragmentError(id, 'fragment missing or out of order');
+                    return null;
+                }
+                if (total > MAX_MESSAGE_SIZE) {
+                    reportFragmentError(id, 'message exceeds maximum size');
+                    return null;
+                }
+                partial = { kind, total, next: 0, received: 0, data: new Uint8Array(total), timer: null };
+                partialMessages.set(id, partial);
+            }
+
+            clearTimeout(partial.timer);
+            if (seq !== partial.next || partial.received + payload.length > partial.total) {
+                partialMessages.delete(id);
+                reportFragmentError(id, 'fragment missing or out of order');
+                return null;
+            }
+            partial.data.set(payload, partial.received);
+            partial.received += payload.length;
+            partial.next++;
+
+            if (partial.received < partial.total) {
+                partial.timer = setTimeout(() => {
+                    partialMessages.delete(id);
+                    reportFragmentError(id, 'timed out waiting for remaining fragments');
+                }, REASSEMBLY_TIMEOUT_MS);
+                return null;
+            }
+            partialMessages.delete(id);
+            return new TextDecoder('utf-8').decode(partial.data);
+        }
+
+        function reportFragmentError(id, message) {
+            console.error('❌ Failed to reassemble message ' + id + ': ' + message);
+            showError('Incomplete message from server', message);
+        }
 
-            dataChannel.send(JSON.stringify(request));
+        function showError(title, message) {
+            const responsesDiv = document.getElementById('apiResponses');
+            const responseElement = document.createElement('div');
+            responseElement.className = 'response';
+            responseElement.style.background = '#ffe6e6';
+            responseElement.innerHTML = '<strong>⚠️ ' + title + ':</strong> ' + message;
+            responsesDiv.insertBefore(responseElement, responsesDiv.firstChild);
         }
 
         function handleDataChannelMessage(event) {
@@ -958,6 +1506,19 @@ const htmlContent = `<!DOCTYPE html>
                 messageText = event.data;
                 console.log('📄 Received as string:', messageText);
             } else if (event.data instanceof ArrayBuffer) {
+                if (event.data.byteLength > 0 && new Uint8Array(event.data)[0] === FRAME_BODY) {
+                    handleBodyFrame(event.data);
+                    return;
+                }
+                if (event.data.byteLength > 0 && new Uint8Array(event.data)[0] === FRAME_FRAGMENT) {
+                    messageText = reassembleFragment(event.data);
+                    if (messageText === null) {
+                        return; // Waiting for more fragments
+                    }
+                    handleParsedMessage(messageText);
+                    return;
+                }
+
                 // Convert ArrayBuffer to string
                 const decoder = new TextDecoder('utf-8');
                 messageText = decoder.decode(event.data);
@@ -978,20 +1539,11 @@ const htmlContent = `<!DOCTYPE html>
         }
         
         function handleParsedMessage(messageText) {
+            let response;
             try {
                 console.log('📥 Parsing JSON:', messageText);
-                const response = JSON.parse(messageText);
+                response = JSON.parse(messageText);
                 console.log('✅ Successfully parsed response:', response);
-                
-                const responsesDiv = document.getElementById('apiResponses');
-                const responseElement = document.createElement('div');
-                responseElement.className = 'response';
-                responseElement.innerHTML = 
-                    '<strong>Status:</strong> ' + response.status + '<br>' +
-                    '<strong>Response:</strong><pre>' + JSON.stringify(response.body, null, 2) + '</pre>';
-                
-                responsesDiv.insertBefore(responseElement, responsesDiv.firstChild);
-                
             } catch (error) {
                 console.error('❌ Failed to parse JSON:', error);
                 console.error('📄 Raw message text:', messageText);
@@ -1007,7 +1559,467 @@ const htmlContent = `<!DOCTYPE html>
                     '<strong>Raw Data:</strong><pre>' + messageText + '</pre>';
                 
                 responsesDiv.insertBefore(responseElement, responsesDiv.firstChild);
+                return;
+            }
+
+            // A batch is answered with an array of responses, in order
+            if (Array.isArray(response)) {
+                response.forEach(item => {
+                    if (item.headers && item.headers['Content-Transfer-Encoding'] === 'base64') {
+                        const bytes = Uint8Array.from(atob(item.body), c => c.charCodeAt(0));
+                        item.body = new Blob([bytes], { type: responseContentType(item) });
+                    }
+                    handleResponse(item);
+                });
+                return;
+            }
+
+            // Events pushed by the server for a subscribed topic
+            if (response.topic && response.event) {
+                handlePushMessage(response);
+                return;
+            }
+
+            // Streamed responses arrive as a header, data chunks and an end marker
+            if (response.stream) {
+                handleStreamMessage(response);
+                return;
+            }
+
+            if (!response.id && response.headers && response.headers['Accept-Encoding']) {
+                serverEncodings = response.headers['Accept-Encoding'].split(',').map(e => e.trim());
+            }
+
+            // Binary bodies follow the envelope in body frames
+            if (response.binary && response.bodyLength > 0) {
+                pendingBodies.set(response.id, { response, data: new Uint8Array(response.bodyLength), received: 0 });
+                return;
+            }
+            if (response.binary) {
+                response.body = new Blob([], { type: responseContentType(response) });
+            }
+            handleResponse(response);
+        }
+
+        // Add a body frame to the binary response it belongs to
+        function handleBodyFrame(buffer) {
+            const bytes = new Uint8Array(buffer);
+            if (bytes.length < 2 || bytes.length < 2 + bytes[1]) {
+                console.error('❌ Malformed body frame');
+                return;
+            }
+            const id = new TextDecoder('utf-8').decode(bytes.subarray(2, 2 + bytes[1]));
+            const payload = bytes.subarray(2 + bytes[1]);
+            const pending = pendingBodies.get(id);
+            if (!pending) {
+                console.warn('⚠️ Body frame for unknown response:', id);
+                return;
+            }
+            if (pending.received + payload.length > pending.data.length) {
+                pendingBodies.delete(id);
+                showError('Invalid binary response', 'body longer than announced for ' + id);
+                return;
+            }
+            pending.data.set(payload, pending.received);
+            pending.received += payload.length;
+            if (pending.received === pending.data.length) {
+                pendingBodies.delete(id);
+                completeBinaryResponse(pending.response, pending.data);
+            }
+        }
+
+        // Decode a fully received binary body. Compressed bodies are
+        // decompressed first, and JSON turns back into an object.
+        function completeBinaryResponse(response, data) {
+            const type = responseContentType(response);
+            const encoding = response.headers && response.headers['Content-Encoding'];
+            if (!encoding) {
+                response.body = new Blob([data], { type });
+                handleResponse(response);
+                return;
+            }
+            const mediaType = type.split(';')[0].trim();
+            transformBytes(data, new DecompressionStream(encoding)).then(bytes => {
+                if (mediaType === 'application/json' || mediaType.endsWith('+json')) {
+                    response.body = JSON.parse(new TextDecoder('utf-8').decode(bytes));
+                } else if (mediaType.startsWith('text/')) {
+                    response.body = new TextDecoder('utf-8').decode(bytes);
+                } else {
+                    response.body = new Blob([bytes], { type });
+                }
+                console.log('🗜️ Decompressed ' + response.id + ' (' + encoding + '): ' + data.length + ' -> ' + bytes.length + ' bytes');
+                handleResponse(response);
+            }).catch(error => {
+                const pending = pendingRequests.get(response.id);
+                if (pending) {
+                    pendingRequests.delete(response.id);
+                    pending.reject(error);
+                }
+                showError('Failed to decompress response ' + response.id, error.message);
+            });
+        }
+
+        function handleStreamMessage(message) {
+            const pending = pendingRequests.get(message.id);
+            if (!pending) {
+                console.warn('⚠️ Stream message for unknown request ID:', message.id);
+                return;
+            }
+
+            if (message.stream === 'begin') {
+                const responsesDiv = document.getElementById('apiResponses');
+                const element = document.createElement('div');
+                element.className = 'response';
+                element.innerHTML =
+                    '<strong>' + pending.method + ' ' + pending.endpoint + '</strong> (' + message.id + ') ' +
+                    '<button onclick="cancelRequest(\'' + message.id + '\')">Cancel</button><br>' +
+                    '<strong>Status:</strong> ' + message.status + ' <em>streaming...</em><br>' +
+                    '<strong>Response:</strong><pre></pre>';
+                responsesDiv.insertBefore(element, responsesDiv.firstChild);
+                pending.stream = { response: message, chunks: [], element };
+                return;
+            }
+            if (!pending.stream) {
+                console.warn('⚠️ Stream chunk before stream header:', message.id);
+                return;
+            }
+
+            const element = pending.stream.element;
+            if (message.stream === 'data') {
+                pending.stream.chunks.push(message.body);
+                element.querySelector('pre').textContent += JSON.stringify(message.body) + '\n';
+            } else if (message.stream === 'end') {
+                pendingRequests.delete(message.id);
+                element.querySelector('em').textContent = message.error ? 'stream ended: ' + message.error : 'stream complete';
+                element.querySelector('button').remove();
+                pending.resolve(Object.assign({}, pending.stream.response, { body: pending.stream.chunks, error: message.error }));
+            }
+        }
+
+        // Start a unary or server-streaming gRPC call with a serialized
+        // request. The promise resolves with every response message once the
+        // call ends with status OK; options.onMessage sees them as they come.
+        function grpcCall(method, request, options = {}) {
+            if (!grpcChannel || grpcChannel.readyState !== 'open') {
+                return Promise.reject(new Error('gRPC data channel not connected'));
+            }
+            const id = nextCallId++;
+            const promise = new Promise((resolve, reject) => {
+                grpcCalls.set(id, { method, messages: [], metadata: {}, onMessage: options.onMessage, resolve, reject });
+                const headers = { method };
+                if (options.timeout) {
+                    headers.timeout = options.timeout;
+                }
+                const message = new Uint8Array(5 + request.length);
+                new DataView(message.buffer).setUint32(1, request.length);
+                message.set(request, 5);
+                try {
+                    grpcChannel.send(grpcFrame(GRPC_FRAME_HEADERS, id, new TextEncoder().encode(JSON.stringify(headers))));
+                    grpcChannel.send(grpcFrame(GRPC_FRAME_MESSAGE, id, message));
+                } catch (error) {
+                    grpcCalls.delete(id);
+                    reject(error);
+                }
+            });
+            promise.callId = id;
+            return promise;
+        }
+
+        function cancelGrpcCall(id) {
+            if (grpcChannel && grpcCalls.has(id)) {
+                grpcChannel.send(grpcFrame(GRPC_FRAME_CANCEL, id, new Uint8Array(0)));
+            }
+        }
+
+        function grpcFrame(type, id, payload) {
+            const frame = new Uint8Array(5 + payload.length);
+            frame[0] = type;
+            new DataView(frame.buffer).setUint32(1, id);
+            frame.set(payload, 5);
+            return frame;
+        }
+
+        function handleGrpcFrame(event) {
+            const bytes = new Uint8Array(event.data);
+            if (bytes.length > 0 && bytes[0] === FRAME_FRAGMENT) {
+                console.warn('⚠️ Fragmented gRPC frames are not supported by this client');
+                return;
+            }
+            if (bytes.length < 5) {
+                console.error('❌ Malformed gRPC frame');
+                return;
+            }
+            const id = new DataView(event.data).getUint32(1);
+            const call = grpcCalls.get(id);
+            if (!call) {
+                console.warn('⚠️ gRPC frame for unknown call:', id);
+                return;
+            }
+            const payload = bytes.subarray(5);
+
+            if (bytes[0] === GRPC_FRAME_HEADERS) {
+                call.metadata = JSON.parse(new TextDecoder('utf-8').decode(payload)).metadata || {};
+            } else if (bytes[0] === GRPC_FRAME_MESSAGE) {
+                const message = payload.subarray(5);
+                call.messages.push(message);
+                if (call.onMessage) {
+                    call.onMessage(message);
+                }
+            } else if (bytes[0] === GRPC_FRAME_TRAILERS) {
+                grpcCalls.delete(id);
+                const trailers = JSON.parse(new TextDecoder('utf-8').decode(payload));
+                const code = trailers.code || 0;
+                if (code === 0) {
+                    call.resolve({ messages: call.messages, metadata: call.metadata, trailers });
+                } else {
+                    const error = new Error(GRPC_CODES[code] + (trailers.message ? ': ' + trailers.message : ''));
+                    error.code = code;
+                    call.reject(error);
+                }
+            }
+        }
+
+        // Just enough protobuf for grpc.health.v1:
+        // HealthCheckRequest { string service = 1; }
+        // HealthCheckResponse { ServingStatus status = 1; }
+        const HEALTH_STATUS = ['UNKNOWN', 'SERVING', 'NOT_SERVING', 'SERVICE_UNKNOWN'];
+
+        function encodeHealthCheckRequest(service) {
+            const name = new TextEncoder().encode(service);
+            // Service names are assumed shorter than 128 bytes (one-byte length)
+            return name.length === 0 ? new Uint8Array(0) : new Uint8Array([0x0a, name.length, ...name]);
+        }
+
+        function decodeHealthCheckResponse(bytes) {
+            return HEALTH_STATUS[bytes.length >= 2 && bytes[0] === 0x08 ? bytes[1] : 0];
+        }
+
+        function showGrpcCall(title) {
+            const responsesDiv = document.getElementById('apiResponses');
+            const element = document.createElement('div');
+            element.className = 'response';
+            element.innerHTML = '<strong>gRPC ' + title + '</strong> <em>running...</em><br><pre></pre>';
+            responsesDiv.insertBefore(element, responsesDiv.firstChild);
+            return element;
+        }
+
+        function grpcHealthCheck() {
+            const element = showGrpcCall('/grpc.health.v1.Health/Check');
+            grpcCall('/grpc.health.v1.Health/Check', encodeHealthCheckRequest(''), { timeout: 5000 })
+                .then(result => {
+                    element.querySelector('em').textContent = 'OK';
+                    element.querySelector('pre').textContent = 'status: ' + decodeHealthCheckResponse(result.messages[0]);
+                })
+                .catch(error => {
+                    element.querySelector('em').textContent = error.message;
+                });
+        }
+
+        function grpcHealthWatch() {
+            const element = showGrpcCall('/grpc.health.v1.Health/Watch');
+            const call = grpcCall('/grpc.health.v1.Health/Watch', encodeHealthCheckRequest(''), {
+                onMessage: message => {
+                    element.querySelector('pre').textContent += new Date().toLocaleTimeString() + ' status: ' + decodeHealthCheckResponse(message) + '\n';
+                }
+            });
+            const cancel = document.createElement('button');
+            cancel.textContent = 'Cancel';
+            cancel.onclick = () => cancelGrpcCall(call.callId);
+            element.querySelector('em').after(' ', cancel);
+            call.then(() => 'stream complete', error => 'stream ended: ' + error.message).then(text => {
+                element.querySelector('em').textContent = text;
+                cancel.remove();
+            });
+        }
+
+        function jsonRpcSend(message) {
+            if (!jsonRpcChannel || jsonRpcChannel.readyState !== 'open') {
+                showError('JSON-RPC', 'data channel not connected');
+                return;
+            }
+            console.log('📤 JSON-RPC:', message);
+            jsonRpcChannel.send(JSON.stringify(message));
+        }
+
+        function jsonRpcCall(method, params) {
+            jsonRpcSend({ jsonrpc: '2.0', method, params, id: nextJsonRpcId++ });
+        }
+
+        // A batch mixing calls, a notification (no id, so no reply) and an
+        // unknown method
+        function jsonRpcBatch() {
+            jsonRpcSend([
+                { jsonrpc: '2.0', method: 'health', id: nextJsonRpcId++ },
+                { jsonrpc: '2.0', method: 'users.list', params: { offset: 1 }, id: nextJsonRpcId++ },
+                { jsonrpc: '2.0', method: 'users.list' },
+                { jsonrpc: '2.0', method: 'no.such.method', id: nextJsonRpcId++ }
+            ]);
+        }
+
+        function showJsonRpcReply(reply) {
+            const responsesDiv = document.getElementById('apiResponses');
+            const element = document.createElement('div');
+            element.className = 'response';
+            element.innerHTML = '<strong>JSON-RPC reply</strong><br><pre></pre>';
+            element.querySelector('pre').textContent = JSON.stringify(reply, null, 2);
+            responsesDiv.insertBefore(element, responsesDiv.firstChild);
+        }
+
+        function sendChat() {
+            const input = document.getElementById('chatText');
+            if (!chatChannel || chatChannel.readyState !== 'open') {
+                showError('Chat', 'data channel not connected');
+                return;
+            }
+            if (input.value.trim() !== '') {
+                chatChannel.send(JSON.stringify({ text: input.value }));
+                input.value = '';
+            }
+        }
+
+        // Uploads send a header, then the file in chunks, pausing whenever
+        // too much is already queued on the channel
+        async function uploadFile() {
+            const file = document.getElementById('uploadFile').files[0];
+            if (!file) {
+                return;
+            }
+            if (!fileChannel || fileChannel.readyState !== 'open') {
+                showError('Upload', 'data channel not connected');
+                return;
+            }
+            const channel = fileChannel;
+            channel.send(JSON.stringify({ name: file.name, size: file.size, type: file.type }));
+            for (let offset = 0; offset < file.size; offset += UPLOAD_CHUNK_SIZE) {
+                if (channel.bufferedAmount > 4 * channel.bufferedAmountLowThreshold) {
+                    await new Promise(resolve => channel.addEventListener('bufferedamountlow', resolve, { once: true }));
+                }
+                if (channel.readyState !== 'open') {
+                    return;
+                }
+                channel.send(await file.slice(offset, offset + UPLOAD_CHUNK_SIZE).arrayBuffer());
+            }
+        }
+
+        async function reportTelemetry() {
+            if (!pc || !telemetryChannel || telemetryChannel.readyState !== 'open') {
+                return;
+            }
+            const seq = ++telemetrySeq;
+            const samples = [];
+            (await pc.getStats()).forEach(report => {
+                if (report.type === 'candidate-pair' && report.nominated && report.currentRoundTripTime !== undefined) {
+                    samples.push({ metric: 'rtt_ms', value: report.currentRoundTripTime * 1000, seq });
+                } else if (report.type === 'inbound-rtp' && report.kind === 'video' && report.framesPerSecond !== undefined) {
+                    samples.push({ metric: 'video_fps', value: report.framesPerSecond, seq });
+                }
+            });
+            if (samples.length > 0 && telemetryChannel && telemetryChannel.readyState === 'open') {
+                telemetryChannel.send(JSON.stringify(samples));
+            }
+        }
+
+        // Keep the newest reading of each server metric, ignoring late ones
+        function handleServerTelemetry(event) {
+            for (const sample of JSON.parse(event.data)) {
+                const last = serverMetrics.get(sample.metric);
+                if (!last || sample.seq > last.seq) {
+                    serverMetrics.set(sample.metric, sample);
+                }
+            }
+            document.getElementById('serverTelemetry').textContent = '📈 Server: ' +
+                Array.from(serverMetrics.values()).map(sample => sample.metric + '=' + sample.value).join(', ');
+        }
+
+        function showChannelMessage(title, message) {
+            const responsesDiv = document.getElementById('apiResponses');
+            const element = document.createElement('div');
+            element.className = 'response';
+            element.innerHTML = '<strong></strong><br><pre></pre>';
+            element.querySelector('strong').textContent = title;
+            element.querySelector('pre').textContent = JSON.stringify(message, null, 2);
+            responsesDiv.insertBefore(element, responsesDiv.firstChild);
+        }
+
+        function handlePushMessage(message) {
+            console.log('📣 Event on ' + message.topic + ':', message.event, message.body);
+            const responsesDiv = document.getElementById('apiResponses');
+            const element = document.createElement('div');
+            element.className = 'response';
+            element.style.background = '#e8f5e9';
+            element.innerHTML =
+                '<strong>📣 ' + message.event + ' on ' + message.topic + '</strong><br>' +
+                '<pre>' + JSON.stringify(message.body, null, 2) + '</pre>';
+            responsesDiv.insertBefore(element, responsesDiv.firstChild);
+        }
+
+        // Ask the server to stop an in-flight request
+        function cancelRequest(id) {
+            if (!dataChannel || dataChannel.readyState !== 'open') {
+                return;
+            }
+            console.log('🛑 Cancelling request ' + id);
+            dataChannel.send(JSON.stringify({ id: id, method: 'CANCEL' }));
+        }
+
+        function cancelLastRequest() {
+            const ids = Array.from(pendingRequests.keys());
+            if (ids.length > 0) {
+                cancelRequest(ids[ids.length - 1]);
+            }
+        }
+
+        function responseContentType(response) {
+            return (response.headers && response.headers['Content-Type']) || 'application/octet-stream';
+        }
+
+        function handleResponse(response) {
+            // Match the response to the request that produced it
+            let title = '';
+            const pending = response.id ? pendingRequests.get(response.id) : null;
+            if (pending) {
+                pendingRequests.delete(response.id);
+                pending.resolve(response);
+                title = '<strong>' + pending.method + ' ' + pending.endpoint + '</strong> (' + response.id + ')<br>';
+            } else if (response.id) {
+                console.warn('⚠️ Response for unknown request ID:', response.id);
+            } else if (response.body && response.body.fragment !== undefined) {
+                // The server could not reassemble one of our fragmented requests
+                const requestId = sentFragments.get(response.body.fragment);
+                const failed = requestId ? pendingRequests.get(requestId) : null;
+                if (failed) {
+                    pendingRequests.delete(requestId);
+                    failed.reject(new Error(response.body.detail));
+                    title = '<strong>' + failed.method + ' ' + failed.endpoint + '</strong> (' + requestId + ')<br>';
+                }
             }
+            if (response.id) {
+                sentFragments.forEach((requestId, fragmentId) => {
+                    if (requestId === response.id) {
+                        sentFragments.delete(fragmentId);
+                    }
+                });
+            }
+
+            let bodyHTML;
+            if (response.body instanceof Blob) {
+                if (response.body.type.startsWith('image/')) {
+                    bodyHTML = '<img src="' + URL.createObjectURL(response.body) + '">';
+                } else {
+                    bodyHTML = '<pre>' + response.body.size + ' bytes of ' + response.body.type + '</pre>';
+                }
+            } else {
+                bodyHTML = '<pre>' + JSON.stringify(response.body, null, 2) + '</pre>';
+            }
+            
+            const responsesDiv = document.getElementById('apiResponses');
+            const responseElement = document.createElement('div');
+            responseElement.className = 'response';
+            responseElement.innerHTML = title +
+                '<strong>Status:</strong> ' + response.status + '<br>' +
+                '<strong>Response:</strong>' + bodyHTML;
+            
+            responsesDiv.insertBefore(responseElement, responsesDiv.firstChild);
         }
 
         // Debug function to manually check data channel status
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Middleware wraps the handling of data channel requests with logic common
+// to all of them, such as authentication, logging or metrics. It is called
+// with the next handler in the chain and returns the handler to use in its
+// place, which may answer a request itself instead of calling next:
+//
+//	func requireToken(next Handler) Handler {
+//		return func(req *Request) RestAPIResponse {
+//			if req.Headers.Get("Authorization") == "" {
+//				return errorResponse(http.StatusUnauthorized, "Missing token")
+//			}
+//			return next(req)
+//		}
+//	}
+//
+// The request's session and peer are available through Request.Session and
+// Request.Peer, and its context through Request.Context. Request.WithContext
+// hands the next handler a request with another context, for example one
+// carrying a deadline or the authenticated user.
+type Middleware func(next Handler) Handler
+
+// requestMiddleware wraps every data channel request, outermost first.
+var requestMiddleware []Middleware
+
+// useMiddleware appends middleware to requestMiddleware, inside the
+// middleware already there. main builds the chain once its flags are
+// parsed, so middleware added after the server has started is not used.
+func useMiddleware(middleware ...Middleware) {
+	requestMiddleware = append(requestMiddleware, middleware...)
+}
+
+// chainMiddleware wraps h in middleware. The first middleware is outermost,
+// so it sees each request first and its response last.
+func chainMiddleware(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Session returns the session the request came from, or nil when it did
+// not arrive over a data channel.
+func (r *Request) Session() *Client {
+	return clientFrom(r.Context())
+}
+
+// Peer identifies the remote end of a session: its session id, the address
+// it signals from, and the SHA-256 fingerprint of the certificate it uses
+// for DTLS, once the handshake has completed.
+type Peer struct {
+	SessionID   string `json:"sessionId"`
+	RemoteAddr  string `json:"remoteAddr,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// Peer returns the identity of the request's peer, or false when it did
+// not arrive over a data channel.
+func (r *Request) Peer() (Peer, bool) {
+	c := r.Session()
+	if c == nil {
+		return Peer{}, false
+	}
+	peer := Peer{SessionID: c.id}
+	if c.conn != nil {
+		peer.RemoteAddr = c.conn.RemoteAddr().String()
+	}
+	if c.peerConn != nil {
+		if sctp := c.peerConn.SCTP(); sctp != nil {
+			if cert := sctp.Transport().GetRemoteCertificate(); len(cert) > 0 {
+				peer.Fingerprint = certificateFingerprint(cert)
+			}
+		}
+	}
+	return peer, true
+}
+
+// certificateFingerprint formats the SHA-256 digest of a DER certificate the
+// way SDP's a=fingerprint does.
+func certificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return "sha-256 " + strings.Join(hex, ":")
+}
+
+// recoverPanics answers requests whose handler panics with a 500, leaving
+// the other requests on the channel unaffected.
+func recoverPanics(next Handler) Handler {
+	return func(req *Request) (response RestAPIResponse) {
+		defer func() {
+			if r := recover(); r != nil {
+				response = panicResponse(r)
+			}
+		}()
+		return next(req)
+	}
+}
+
+// logRequests logs every request once it has been answered, with its
+// session, status and duration.
+func logRequests(next Handler) Handler {
+	return func(req *Request) RestAPIResponse {
+		start := time.Now()
+		response := next(req)
+		session := "-"
+		if c := req.Session(); c != nil {
+			session = c.id
+		}
+		method := req.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		log.Printf("📒 %s %s %s %d %v", session, method, req.Endpoint, response.Status, time.Since(start).Round(time.Microsecond))
+		return response
+	}
+}
+
+// timeRequests reports how long the handler took in a Server-Timing
+// header. For streamed responses this is the time until the stream began.
+func timeRequests(next Handler) Handler {
+	return func(req *Request) RestAPIResponse {
+		start := time.Now()
+		response := next(req)
+		elapsed := float64(time.Since(start).Microseconds()) / 1000
+		response.Headers = response.Headers.Clone()
+		response.Headers.Add("Server-Timing", fmt.Sprintf("app;dur=%.3f", elapsed))
+		return response
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+// The REST endpoints are described by an OpenAPI 3 document. Each of its
+// operations becomes a route served by the handler registered under the
+// operation's operationId, and requests are validated against the
+// operation's parameters and request body before they reach it. The
+// document below is used unless -openapi names another one.
+//
+//go:embed openapi.yaml
+var defaultOpenAPI []byte
+
+// problemSchemaViolation answers requests that do not match the spec.
+const problemSchemaViolation = "/problems/schema-violation"
+
+// apiSpec is the loaded OpenAPI document, served at /api/openapi.json.
+var apiSpec *openapi3.T
+
+// loadOpenAPI reads and validates the OpenAPI document at path, or the
+// built-in one when path is empty.
+func loadOpenAPI(path string) (*openapi3.T, error) {
+	loader := openapi3.NewLoader()
+	var (
+		spec *openapi3.T
+		err  error
+	)
+	if path == "" {
+		spec, err = loader.LoadFromData(defaultOpenAPI)
+	} else {
+		spec, err = loader.LoadFromFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := spec.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+	return spec, nil
+}
+
+// routeOperations registers every operation in spec with r. Operations
+// without a handler in handlers answer 501, so a spec can describe
+// endpoints before they are implemented.
+func routeOperations(r *Router, spec *openapi3.T, handlers map[string]Handler) {
+	for _, path := range spec.Paths.InMatchingOrder() {
+		pathItem := spec.Paths.Value(path)
+		for method, op := range pathItem.Operations() {
+			h, ok := handlers[op.OperationID]
+			if !ok {
+				log.Printf("⚠️ No handler for %s %s (operationId %q)", method, path, op.OperationID)
+				h = notImplemented
+			}
+			route := &routers.Route{Spec: spec, Path: path, PathItem: pathItem, Method: method, Operation: op}
+			r.Handle(method, path, validateRequests(route, h))
+		}
+	}
+}
+
+func notImplemented(req *Request) RestAPIResponse {
+	return errorResponse(http.StatusNotImplemented, "Not implemented")
+}
+
+// Violation is one way a request fails to match the spec. In is "path",
+// "query", "header" or "body"; Name is the parameter, or the JSON pointer
+// of the offending part of the body.
+type Violation struct {
+	In      string `json:"in"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message"`
+}
+
+// validateRequests wraps h so that requests which do not match route's
+// operation are answered with 400 and the list of violations.
+func validateRequests(route *routers.Route, h Handler) Handler {
+	return func(req *Request) RestAPIResponse {
+		if violations := validateRequest(req.Context(), route, req); len(violations) > 0 {
+			return newProblem(http.StatusBadRequest, problemSchemaViolation, "Request does not match the API specification").
+				With("violations", violations).Response()
+		}
+		return h(req)
+	}
+}
+
+// validateRequest checks req against route's operation. The request is
+// rebuilt as an http.Request for the validator; req itself is untouched.
+func validateRequest(ctx context.Context, route *routers.Route, req *Request) []Violation {
+	body, err := encodeRequestBody(req.RestAPIMessage)
+	if err != nil {
+		return []Violation{{In: "body", Message: "cannot be encoded"}}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, route.Method, req.Endpoint, body)
+	if err != nil {
+		return []Violation{{In: "path", Message: "invalid endpoint"}}
+	}
+	httpReq.Header = http.Header(req.Headers.Clone())
+	if body != nil && httpReq.Header.Get("Content-Type") == "" {
+		httpReq.Header.Set("Content-Type", requestContentType(req.RestAPIMessage))
+	}
+
+	err = openapi3filter.ValidateRequest(ctx, &openapi3filter.RequestValidationInput{
+		Request:     httpReq,
+		PathParams:  req.Params,
+		QueryParams: req.Query,
+		Route:       route,
+		Options: &openapi3filter.Options{
+			MultiError:          true,
+			SkipSettingDefaults: true,
+			AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc,
+		},
+	})
+	if err == nil {
+		return nil
+	}
+	return violations(err, "", "")
+}
+
+// violations flattens the errors reported by the validator. in and name
+// describe the request part the enclosing error was about.
+func violations(err error, in, name string) []Violation {
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		var all []Violation
+		for _, inner := range e {
+			all = append(all, violations(inner, in, name)...)
+		}
+		return all
+	case *openapi3filter.RequestError:
+		switch {
+		case e.Parameter != nil:
+			in, name = e.Parameter.In, e.Parameter.Name
+			// Values that do not even parse are reported by their
+			// expected type rather than by the parser's error
+			var parseErr *openapi3filter.ParseError
+			if errors.As(e.Err, &parseErr) && e.Parameter.Schema != nil && e.Parameter.Schema.Value != nil {
+				if types := e.Parameter.Schema.Value.Type.Slice(); len(types) > 0 {
+					return []Violation{{In: in, Name: name, Message: "value must be of type " + strings.Join(types, " or ")}}
+				}
+			}
+		case e.RequestBody != nil:
+			in = "body"
+		}
+		if e.Err == nil {
+			return []Violation{{In: in, Name: name, Message: e.Reason}}
+		}
+		return violations(e.Err, in, name)
+	case *openapi3.SchemaError:
+		if pointer := e.JSONPointer(); in == "body" && len(pointer) > 0 {
+			name = "/" + strings.Join(pointer, "/")
+		}
+		return []Violation{{In: in, Name: name, Message: e.Reason}}
+	case *openapi3filter.ParseError:
+		if e.Reason == "" && e.Cause != nil {
+			return violations(e.Cause, in, name)
+		}
+		return []Violation{{In: in, Name: name, Message: e.Reason}}
+	}
+	return []Violation{{In: in, Name: name, Message: err.Error()}}
+}
+
+// getOpenAPI serves the spec the routes were generated from.
+func getOpenAPI(req *Request) RestAPIResponse {
+	return jsonResponse(http.StatusOK, apiSpec)
+}
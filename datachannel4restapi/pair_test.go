@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// newPair connects two peers in-process and returns both ends of a data
+// channel called label, once it is open, and the peers themselves.
+func newPair(t *testing.T, label string, init *webrtc.DataChannelInit) (dcA, dcB *webrtc.DataChannel, pcA, pcB *webrtc.PeerConnection) {
+	t.Helper()
+	pcA, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pcA.Close() })
+	pcB, err = webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pcB.Close() })
+
+	dcA, err = pcA.CreateDataChannel(label, init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := make(chan struct{})
+	dcA.OnOpen(func() { close(opened) })
+	accepted := make(chan *webrtc.DataChannel, 1)
+	pcB.OnDataChannel(func(dc *webrtc.DataChannel) { accepted <- dc })
+
+	offer, err := pcA.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pcA)
+	if err := pcA.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := pcB.SetRemoteDescription(*pcA.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := pcB.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(pcB)
+	if err := pcB.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := pcA.SetRemoteDescription(*pcB.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(10 * time.Second)
+	select {
+	case dcB = <-accepted:
+	case <-timeout:
+		t.Fatal("data channel never reached the other peer")
+	}
+	select {
+	case <-opened:
+	case <-timeout:
+		t.Fatal("data channel never opened")
+	}
+	return dcA, dcB, pcA, pcB
+}
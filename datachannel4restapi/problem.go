@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+)
+
+// Errors are answered with RFC 7807 problem details. Problems without a more
+// specific type use "about:blank", meaning the HTTP status says it all; the
+// ones below let clients tell the data channel's own failures apart.
+const (
+	problemMalformedRequest = "/problems/malformed-request"
+	problemUnknownMethod    = "/problems/unknown-method"
+	problemTooLarge         = "/problems/too-large"
+	problemInternalError    = "/problems/internal-error"
+	problemValidation       = "/problems/validation"
+	problemRateLimited      = "/problems/rate-limited"
+
+	problemIdempotencyKeyReused = "/problems/idempotency-key-reused"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object. Extensions are extra
+// members, such as the invalid fields of a validation problem.
+type Problem struct {
+	Type       string
+	Title      string
+	Status     int
+	Detail     string
+	Instance   string
+	Extensions map[string]interface{}
+}
+
+// newProblem describes a failure with the given status. An empty
+// problemType means "about:blank".
+func newProblem(status int, problemType, detail string) *Problem {
+	if problemType == "" {
+		problemType = "about:blank"
+	}
+	return &Problem{Type: problemType, Title: http.StatusText(status), Status: status, Detail: detail}
+}
+
+// With adds the extension member key to p.
+func (p *Problem) With(key string, value interface{}) *Problem {
+	if p.Extensions == nil {
+		p.Extensions = make(map[string]interface{})
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+// Response wraps p in an application/problem+json response.
+func (p *Problem) Response() RestAPIResponse {
+	return RestAPIResponse{
+		Status:  p.Status,
+		Headers: Header{"Content-Type": {problemContentType}},
+		Body:    p,
+	}
+}
+
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	members := make(map[string]interface{}, len(p.Extensions)+5)
+	for key, value := range p.Extensions {
+		members[key] = value
+	}
+	members["type"] = p.Type
+	members["title"] = p.Title
+	members["status"] = p.Status
+	if p.Detail != "" {
+		members["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		members["instance"] = p.Instance
+	}
+	return json.Marshal(members)
+}
+
+// errorResponse answers with a generic problem for status.
+func errorResponse(status int, message string) RestAPIResponse {
+	return newProblem(status, "", message).Response()
+}
+
+// requestIDPattern finds the id of an envelope that is not valid JSON.
+var requestIDPattern = regexp.MustCompile(`"id"\s*:\s*"((?:[^"\\]|\\.)*)"`)
+
+// recoverRequestID makes a best effort to find the request ID in a message
+// that could not be parsed, so the error can still be matched to its
+// request.
+func recoverRequestID(data []byte) string {
+	var members map[string]json.RawMessage
+	if json.Unmarshal(data, &members) == nil {
+		var id string
+		json.Unmarshal(members["id"], &id)
+		return id
+	}
+	if m := requestIDPattern.FindSubmatch(data); m != nil {
+		var id string
+		if json.Unmarshal(append(append([]byte{'"'}, m[1]...), '"'), &id) == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+// requestMethods are the methods a request envelope may use besides the
+// control methods. An empty method means GET.
+var requestMethods = map[string]bool{
+	"":                 true,
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// allowedMethods lists every method a request envelope may use, for Allow
+// headers.
+func allowedMethods() string {
+	return strings.Join([]string{
+		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, methodCancel, methodSubscribe, methodUnsubscribe, methodHello,
+	}, ", ")
+}
+
+// panicResponse logs a recovered handler panic and describes it to the
+// client without revealing its details.
+func panicResponse(r interface{}) RestAPIResponse {
+	logPanic(r)
+	return newProblem(http.StatusInternalServerError, problemInternalError, "The request could not be completed because of an internal error").Response()
+}
+
+func logPanic(r interface{}) {
+	log.Printf("🔥 Recovered from panic: %v\n%s", r, debug.Stack())
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxUpstreamResponseSize caps how much of an upstream response body is read
+// into a single RestAPIResponse.
+const maxUpstreamResponseSize = 10 << 20
+
+// hopHeaders are connection-specific headers that must not be forwarded
+// between the data channel and the upstream service.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// upstreamRoute maps endpoints starting with prefix onto an upstream base URL.
+type upstreamRoute struct {
+	prefix string
+	target *url.URL
+}
+
+// upstreamProxy forwards data channel REST calls to real HTTP services.
+type upstreamProxy struct {
+	routes []upstreamRoute
+	client *http.Client
+}
+
+var upstreams = &upstreamProxy{client: &http.Client{Timeout: 10 * time.Second}}
+
+// String implements flag.Value.
+func (p *upstreamProxy) String() string {
+	if p == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(p.routes))
+	for _, route := range p.routes {
+		parts = append(parts, route.prefix+"="+route.target.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set implements flag.Value. Each value has the form "prefix=url", for
+// example "/api/legacy=http://10.0.0.5:9000/v1".
+func (p *upstreamProxy) Set(value string) error {
+	prefix, rawURL, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("upstream must look like /prefix=http://host:port, got %q", value)
+	}
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+		return fmt.Errorf("upstream %q must be an absolute http(s) URL", rawURL)
+	}
+
+	p.routes = append(p.routes, upstreamRoute{prefix: strings.TrimSuffix(prefix, "/"), target: target})
+	// Longest prefix wins when routes overlap
+	sort.SliceStable(p.routes, func(i, j int) bool {
+		return len(p.routes[i].prefix) > len(p.routes[j].prefix)
+	})
+	return nil
+}
+
+// match returns the route serving endpoint, or nil if it is not proxied.
+func (p *upstreamProxy) match(endpoint string) *upstreamRoute {
+	path, _, _ := strings.Cut(endpoint, "?")
+	for i := range p.routes {
+		prefix := p.routes[i].prefix
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return &p.routes[i]
+		}
+	}
+	return nil
+}
+
+// forward turns request into an HTTP call against the route's upstream and
+// converts the answer back into a RestAPIResponse.
+func (p *upstreamProxy) forward(ctx context.Context, route *upstreamRoute, request RestAPIMessage) RestAPIResponse {
+	endpoint, err := url.Parse(request.Endpoint)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "Invalid endpoint")
+	}
+
+	// Dot segments must not lead out of the proxied prefix
+	cleaned := path.Clean("/" + endpoint.Path)
+	if cleaned != route.prefix && !strings.HasPrefix(cleaned, route.prefix+"/") {
+		return errorResponse(http.StatusBadRequest, "Endpoint leaves "+route.prefix)
+	}
+	if strings.HasSuffix(endpoint.Path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	target := *route.target
+	target.Path = strings.TrimSuffix(target.Path, "/") + strings.TrimPrefix(cleaned, route.prefix)
+	target.RawQuery = endpoint.RawQuery
+
+	body, err := encodeRequestBody(request)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "Invalid request body")
+	}
+
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "Invalid request")
+	}
+	httpReq.Header = http.Header(request.Headers.Clone())
+	if body != nil && httpReq.Header.Get("Content-Type") == "" {
+		httpReq.Header.Set("Content-Type", requestContentType(request))
+	}
+	for _, h := range hopHeaders {
+		httpReq.Header.Del(h)
+	}
+	// Accept-Encoding is about compressing the envelope (see compression.go).
+	// Without it the transport asks for gzip itself and decodes the answer,
+	// so the body below is always plain.
+	httpReq.Header.Del("Accept-Encoding")
+	httpReq.Header.Set("X-Forwarded-Proto", "webrtc")
+
+	log.Printf("Proxying %s %s to %s", method, request.Endpoint, target.String())
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+			log.Printf("Upstream timeout for %s: %v", request.Endpoint, err)
+			return errorResponse(http.StatusGatewayTimeout, "Upstream timed out")
+		}
+		log.Printf("Upstream error for %s: %v", request.Endpoint, err)
+		return errorResponse(http.StatusBadGateway, "Upstream unavailable")
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamResponseSize+1))
+	if err != nil {
+		log.Printf("Failed to read upstream response for %s: %v", request.Endpoint, err)
+		return errorResponse(http.StatusBadGateway, "Upstream response incomplete")
+	}
+	if len(data) > maxUpstreamResponseSize {
+		return errorResponse(http.StatusBadGateway, "Upstream response too large")
+	}
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	// The body is re-encoded inside the envelope, so its length changes
+	resp.Header.Del("Content-Length")
+	response := RestAPIResponse{Status: resp.StatusCode, Headers: Header(resp.Header)}
+	response.Body, response.RawBody = decodeBody(resp.Header.Get("Content-Type"), data)
+	return response
+}
+
+// decodeBody converts an HTTP body into envelope form. JSON payloads are
+// embedded verbatim, other text becomes a string, and binary content types
+// are kept as raw bytes so they can be sent without base64 encoding.
+func decodeBody(contentType string, data []byte) (interface{}, []byte) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if isBinaryContentType(contentType) {
+		return nil, data
+	}
+	if strings.Contains(contentType, "json") && json.Valid(data) {
+		return json.RawMessage(data), nil
+	}
+	return string(data), nil
+}
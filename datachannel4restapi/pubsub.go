@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// SUBSCRIBE and UNSUBSCRIBE messages use the endpoint as the topic name, for
+// example {"id": "req-1", "method": "SUBSCRIBE", "endpoint": "/api/users"}.
+const (
+	methodSubscribe   = "SUBSCRIBE"
+	methodUnsubscribe = "UNSUBSCRIBE"
+)
+
+// PushMessage is an event the server sends, unsolicited, to every data
+// channel subscribed to Topic.
+type PushMessage struct {
+	Topic string      `json:"topic"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// Broker tracks topic subscriptions across all sessions and fans published
+// events out to the subscribed data channels.
+type Broker struct {
+	mu     sync.RWMutex
+	topics map[string]map[*restChannel]struct{}
+}
+
+var broker = NewBroker()
+
+func NewBroker() *Broker {
+	return &Broker{topics: make(map[string]map[*restChannel]struct{})}
+}
+
+// Subscribe adds rc to topic's subscribers. It reports false if rc was
+// already subscribed.
+func (b *Broker) Subscribe(topic string, rc *restChannel) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subscribers, ok := b.topics[topic]
+	if !ok {
+		subscribers = make(map[*restChannel]struct{})
+		b.topics[topic] = subscribers
+	}
+	if _, exists := subscribers[rc]; exists {
+		return false
+	}
+	subscribers[rc] = struct{}{}
+	return true
+}
+
+// Unsubscribe removes rc from topic's subscribers. It reports false if rc
+// was not subscribed.
+func (b *Broker) Unsubscribe(topic string, rc *restChannel) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subscribers, ok := b.topics[topic]
+	if !ok {
+		return false
+	}
+	if _, exists := subscribers[rc]; !exists {
+		return false
+	}
+	delete(subscribers, rc)
+	if len(subscribers) == 0 {
+		delete(b.topics, topic)
+	}
+	return true
+}
+
+// UnsubscribeAll removes rc from every topic, returning how many
+// subscriptions it held.
+func (b *Broker) UnsubscribeAll(rc *restChannel) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	removed := 0
+	for topic, subscribers := range b.topics {
+		if _, exists := subscribers[rc]; exists {
+			delete(subscribers, rc)
+			removed++
+		}
+		if len(subscribers) == 0 {
+			delete(b.topics, topic)
+		}
+	}
+	return removed
+}
+
+// pushQueueDepth bounds how many events may wait to be pushed on one data
+// channel. Events for a channel that far behind are dropped, so a slow
+// subscriber never holds up the publisher.
+const pushQueueDepth = 64
+
+// Publish queues an event for every subscriber of topic and returns how many
+// data channels it was queued for. It never waits for a subscriber.
+func (b *Broker) Publish(topic, event string, body interface{}) int {
+	b.mu.RLock()
+	subscribers := make([]*restChannel, 0, len(b.topics[topic]))
+	for rc := range b.topics[topic] {
+		subscribers = append(subscribers, rc)
+	}
+	b.mu.RUnlock()
+
+	push := PushMessage{Topic: topic, Event: event, Body: body}
+	queued := 0
+	for _, rc := range subscribers {
+		select {
+		case rc.pushes <- push:
+			queued++
+		default:
+			rc.channel.out.dropped.Add(1)
+			log.Printf("Dropped %s %s event, its data channel is backed up", topic, event)
+		}
+	}
+	if len(subscribers) > 0 {
+		log.Printf("📣 Published %s %s event to %d subscribers", topic, event, queued)
+	}
+	return queued
+}
+
+// pushEvents sends the events published to rc's topics until rc closes.
+func (rc *restChannel) pushEvents() {
+	for {
+		select {
+		case <-rc.ctx.Done():
+			return
+		case push := <-rc.pushes:
+			if err := rc.sendMessage(push); err != nil {
+				log.Printf("Failed to push %s %s event: %v", push.Topic, push.Event, err)
+			}
+		}
+	}
+}
+
+// handleSubscription answers a SUBSCRIBE or UNSUBSCRIBE request from rc.
+func (rc *restChannel) handleSubscription(request RestAPIMessage) RestAPIResponse {
+	topic, _, _ := strings.Cut(request.Endpoint, "?")
+	if !strings.HasPrefix(topic, "/") {
+		return errorResponse(http.StatusBadRequest, "Topic must be an endpoint path such as /api/users")
+	}
+
+	if request.Method == methodSubscribe {
+		if broker.Subscribe(topic, rc) {
+			log.Printf("📬 Subscribed to %s", topic)
+		}
+		return RestAPIResponse{
+			Status:  http.StatusOK,
+			Headers: Header{"Content-Type": {"application/json"}},
+			Body:    map[string]interface{}{"topic": topic, "subscribed": true},
+		}
+	}
+
+	if !broker.Unsubscribe(topic, rc) {
+		return errorResponse(http.StatusNotFound, "Not subscribed to "+topic)
+	}
+	log.Printf("📭 Unsubscribed from %s", topic)
+	return RestAPIResponse{
+		Status:  http.StatusOK,
+		Headers: Header{"Content-Type": {"application/json"}},
+		Body:    map[string]interface{}{"topic": topic, "subscribed": false},
+	}
+}
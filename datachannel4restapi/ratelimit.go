@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each session's REST requests are limited by a token bucket refilled at
+// Rate requests per second and holding up to Burst of them. Endpoint limits
+// override the session's for the requests they match, with buckets of their
+// own. Requests over the limit answer 429 with a Retry-After header, and a
+// session that has more than MaxViolations requests refused within
+// ViolationWindow is closed.
+type RateLimitConfig struct {
+	Rate            float64         `json:"rate"`
+	Burst           int             `json:"burst"`
+	Endpoints       []EndpointLimit `json:"endpoints"`
+	MaxViolations   int             `json:"maxViolations"`
+	ViolationWindow configDuration  `json:"violationWindow"`
+}
+
+// EndpointLimit limits requests whose path matches Pattern, which may hold
+// {name} segments like a route. An empty Method matches every method.
+type EndpointLimit struct {
+	Method  string  `json:"method,omitempty"`
+	Pattern string  `json:"pattern"`
+	Rate    float64 `json:"rate"`
+	Burst   int     `json:"burst"`
+
+	segments []string
+}
+
+// configDuration is a time.Duration written as a string such as "10s".
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(parsed)
+	return nil
+}
+
+// rateLimits applies to every new session. A zero Rate disables limiting.
+var rateLimits = &RateLimitConfig{
+	Rate:            20,
+	Burst:           50,
+	MaxViolations:   100,
+	ViolationWindow: configDuration(10 * time.Second),
+}
+
+// loadRateLimits reads a RateLimitConfig from a JSON file. Settings the
+// file leaves out keep their defaults.
+func loadRateLimits(path string) (*RateLimitConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := *rateLimits
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if config.Rate < 0 || config.Burst < 0 || config.MaxViolations < 0 || config.ViolationWindow < 0 {
+		return nil, fmt.Errorf("%s: rate, burst, maxViolations and violationWindow must not be negative", path)
+	}
+	for i := range config.Endpoints {
+		limit := &config.Endpoints[i]
+		if !strings.HasPrefix(limit.Pattern, "/") {
+			return nil, fmt.Errorf("%s: endpoint pattern %q must start with /", path, limit.Pattern)
+		}
+		if limit.Rate <= 0 || limit.Burst < 0 {
+			return nil, fmt.Errorf("%s: endpoint %s needs a positive rate", path, limit.Pattern)
+		}
+		limit.Method = strings.ToUpper(limit.Method)
+		limit.segments = splitPath(limit.Pattern)
+	}
+	return &config, nil
+}
+
+// tokenBucket holds up to burst tokens and gains rate of them per second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take spends a token if one is available. Otherwise it returns how long
+// until one will be.
+func (b *tokenBucket) take(now time.Time) (time.Duration, bool) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), false
+}
+
+// rateLimiter enforces a RateLimitConfig for one session.
+type rateLimiter struct {
+	config  *RateLimitConfig
+	onAbuse func()
+
+	mu          sync.Mutex
+	session     *tokenBucket
+	endpoints   []*tokenBucket
+	windowStart time.Time
+	violations  int
+	abusive     bool
+}
+
+// newRateLimiter limits a session by config. onAbuse is called once, when
+// the session has ignored the limits too often.
+func newRateLimiter(config *RateLimitConfig, onAbuse func()) *rateLimiter {
+	l := &rateLimiter{config: config, onAbuse: onAbuse}
+	if config.Rate > 0 {
+		l.session = newTokenBucket(config.Rate, config.Burst)
+	}
+	for _, limit := range config.Endpoints {
+		l.endpoints = append(l.endpoints, newTokenBucket(limit.Rate, limit.Burst))
+	}
+	return l
+}
+
+// allow charges a request for method and endpoint to its bucket. When the
+// bucket is empty it returns how long the client should wait.
+func (l *rateLimiter) allow(method, endpoint string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.take(l.bucket(method, endpoint), method, endpoint)
+}
+
+// allowSession charges a message that is not itself a request, such as a
+// batch, to the session's bucket.
+func (l *rateLimiter) allowSession(what string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.take(l.session, what, "")
+}
+
+// take spends a token from bucket and counts a violation if there is none.
+// l.mu must be held.
+func (l *rateLimiter) take(bucket *tokenBucket, method, endpoint string) (time.Duration, bool) {
+	now := time.Now()
+	if bucket == nil {
+		return 0, true
+	}
+	wait, ok := bucket.take(now)
+	if ok {
+		return 0, true
+	}
+
+	window := time.Duration(l.config.ViolationWindow)
+	if now.Sub(l.windowStart) > window {
+		l.windowStart = now
+		l.violations = 0
+	}
+	l.violations++
+	if l.violations == 1 {
+		log.Printf("Rate limiting %s %s", method, endpoint)
+	}
+	if l.config.MaxViolations > 0 && l.violations > l.config.MaxViolations && !l.abusive {
+		l.abusive = true
+		go l.onAbuse()
+	}
+	return wait, false
+}
+
+// bucket finds the bucket of the first endpoint limit matching the
+// request, or the session's.
+func (l *rateLimiter) bucket(method, endpoint string) *tokenBucket {
+	if len(l.endpoints) > 0 {
+		if u, err := url.Parse(endpoint); err == nil {
+			segments := splitPath(u.Path)
+			method = strings.ToUpper(method)
+			if method == "" {
+				method = http.MethodGet
+			}
+			for i, limit := range l.config.Endpoints {
+				if limit.Method != "" && limit.Method != method {
+					continue
+				}
+				if _, ok := matchSegments(limit.segments, segments); ok {
+					return l.endpoints[i]
+				}
+			}
+		}
+	}
+	return l.session
+}
+
+// rateLimitedResponse tells the client to retry after wait.
+func rateLimitedResponse(wait time.Duration) RestAPIResponse {
+	seconds := retryAfter(wait)
+	response := newProblem(http.StatusTooManyRequests, problemRateLimited,
+		fmt.Sprintf("Rate limit exceeded, retry in %d s", seconds)).With("retryAfter", seconds).Response()
+	response.Headers.Set("Retry-After", strconv.Itoa(seconds))
+	return response
+}
+
+// retryAfter rounds wait up to the whole seconds of a Retry-After header.
+func retryAfter(wait time.Duration) int {
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
+
+// allowCall charges a call that did not come in as a REST envelope, such as
+// a JSON-RPC or gRPC call, to the rate limit of the session in ctx.
+func allowCall(ctx context.Context, method, endpoint string) (time.Duration, bool) {
+	c := clientFrom(ctx)
+	if c == nil || c.limiter == nil {
+		return 0, true
+	}
+	return c.limiter.allow(method, endpoint)
+}
+
+// allowSessionCall charges a message that is not itself a call, such as a
+// JSON-RPC batch, to the session bucket of the session in ctx.
+func allowSessionCall(ctx context.Context, what string) (time.Duration, bool) {
+	c := clientFrom(ctx)
+	if c == nil || c.limiter == nil {
+		return 0, true
+	}
+	return c.limiter.allowSession(what)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	type take struct {
+		after    time.Duration // since start
+		wantOK   bool
+		wantWait time.Duration
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		takes []take
+	}{
+		{
+			name: "burst then empty",
+			rate: 1, burst: 3,
+			takes: []take{{0, true, 0}, {0, true, 0}, {0, true, 0}, {0, false, time.Second}},
+		},
+		{
+			name: "refills at rate",
+			rate: 10, burst: 1,
+			takes: []take{{0, true, 0}, {50 * time.Millisecond, false, 50 * time.Millisecond}, {100 * time.Millisecond, true, 0}},
+		},
+		{
+			name: "refill stops at burst",
+			rate: 100, burst: 2,
+			takes: []take{{time.Hour, true, 0}, {time.Hour, true, 0}, {time.Hour, false, 10 * time.Millisecond}},
+		},
+		{
+			name: "burst defaults to rate",
+			rate: 2.5, burst: 0,
+			takes: []take{{0, true, 0}, {0, true, 0}, {0, true, 0}, {0, false, 400 * time.Millisecond}},
+		},
+		{
+			name: "burst of at least one",
+			rate: 0.5, burst: 0,
+			takes: []take{{0, true, 0}, {0, false, 2 * time.Second}, {2 * time.Second, true, 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate, tt.burst)
+			b.last = start
+			for i, tk := range tt.takes {
+				wait, ok := b.take(start.Add(tk.after))
+				if ok != tk.wantOK {
+					t.Fatalf("take %d: ok = %v, want %v", i, ok, tk.wantOK)
+				}
+				if diff := wait - tk.wantWait; diff < -time.Millisecond || diff > time.Millisecond {
+					t.Fatalf("take %d: wait = %v, want %v", i, wait, tk.wantWait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterBuckets(t *testing.T) {
+	config := &RateLimitConfig{
+		Rate:  1000,
+		Burst: 1000,
+		Endpoints: []EndpointLimit{
+			{Method: "POST", Pattern: "/api/users", Rate: 1, Burst: 1},
+			{Pattern: "/api/users/{id}", Rate: 1, Burst: 2},
+		},
+	}
+	for i := range config.Endpoints {
+		config.Endpoints[i].segments = splitPath(config.Endpoints[i].Pattern)
+	}
+	l := newRateLimiter(config, func() {})
+
+	tests := []struct {
+		method   string
+		endpoint string
+		wantOK   bool
+	}{
+		{"POST", "/api/users", true},
+		{"POST", "/api/users", false},
+		{"GET", "/api/users", true}, // Session bucket
+		{"GET", "/api/users/1?x=y", true},
+		{"DELETE", "/api/users/2", true},
+		{"PATCH", "/api/users/3", false}, // {id} shares one bucket
+		{"", "/api/health", true},
+	}
+	for _, tt := range tests {
+		if _, ok := l.allow(tt.method, tt.endpoint); ok != tt.wantOK {
+			t.Errorf("%s %s: allowed = %v, want %v", tt.method, tt.endpoint, ok, tt.wantOK)
+		}
+	}
+}
+
+func TestRateLimiterAbuse(t *testing.T) {
+	abused := make(chan struct{}, 2)
+	l := newRateLimiter(&RateLimitConfig{
+		Rate:            0.001,
+		Burst:           1,
+		MaxViolations:   3,
+		ViolationWindow: configDuration(time.Minute),
+	}, func() { abused <- struct{}{} })
+
+	if _, ok := l.allow("GET", "/"); !ok {
+		t.Fatal("first request refused")
+	}
+	for i := 0; i < 3; i++ {
+		l.allow("GET", "/")
+	}
+	select {
+	case <-abused:
+		t.Fatal("onAbuse called at MaxViolations")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	l.allow("GET", "/")
+	l.allow("GET", "/")
+	select {
+	case <-abused:
+	case <-time.After(time.Second):
+		t.Fatal("onAbuse not called past MaxViolations")
+	}
+	select {
+	case <-abused:
+		t.Fatal("onAbuse called twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestRateLimitedResponse(t *testing.T) {
+	response := rateLimitedResponse(1500 * time.Millisecond)
+	if response.Status != 429 {
+		t.Fatalf("status = %d, want 429", response.Status)
+	}
+	if got := response.Headers.Get("Retry-After"); got != "2" {
+		t.Fatalf("Retry-After = %q, want 2", got)
+	}
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Binary bodies travel after their JSON envelope as body frames:
+//
+//	type(1) | id length(1) | request id | payload
+//
+// The envelope announces the total size in bodyLength; the body is complete
+// once that many payload bytes have arrived for the request id.
+const frameBody byte = 0x02
+
+// maxBodyFrameID is the longest request id a body frame can carry.
+const maxBodyFrameID = 255
+
+// bodyChunkSize keeps every body frame, with its 2-byte header and longest
+// id, within a single data channel message.
+const bodyChunkSize = fragmentSize - 2 - maxBodyFrameID
+
+// statusClientClosedRequest answers requests the client cancelled. It is
+// the non-standard code popularised by nginx.
+const statusClientClosedRequest = 499
+
+var (
+	errRequestTimeout   = errors.New("request timed out")
+	errRequestCancelled = errors.New("request cancelled by client")
+)
+
+// requestTimeout bounds requests whose envelope does not set a timeout.
+// Zero means no limit.
+var requestTimeout = 60 * time.Second
+
+// restLabel is the data channel label that carries REST envelopes.
+const restLabel = "rest-api"
+
+// maxPendingBodies bounds how many binary request bodies may be arriving on
+// one channel at a time.
+const maxPendingBodies = 16
+
+// pendingBody collects the binary body of a request whose envelope has
+// already arrived.
+type pendingBody struct {
+	request  RestAPIMessage
+	received int
+	discard  bool
+	timer    *time.Timer
+}
+
+// restChannel serves REST-style requests arriving on a data channel.
+type restChannel struct {
+	channel *framedChannel
+
+	// ctx is cancelled when the channel or its peer connection closes,
+	// stopping every request still in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// limiter is the session's rate limiter; nil means no limits
+	limiter *rateLimiter
+
+	// pushes holds published events until pushEvents sends them
+	pushes chan PushMessage
+
+	// codec encodes envelopes; nil means JSON. received records whether
+	// any message has arrived yet, as HELLO must come first.
+	codec    atomic.Pointer[binaryCodec]
+	received atomic.Bool
+
+	mu       sync.Mutex
+	bodies   map[string]*pendingBody
+	inflight map[string]context.CancelCauseFunc
+}
+
+// newRestChannel serves requests arriving on dc until it closes or ctx, the
+// peer connection's context, is cancelled.
+func newRestChannel(ctx context.Context, dc *webrtc.DataChannel) *restChannel {
+	ctx, cancel := context.WithCancel(ctx)
+	rc := &restChannel{
+		channel:  newFramedChannel(dc, maxMessageSize),
+		ctx:      ctx,
+		cancel:   cancel,
+		pushes:   make(chan PushMessage, pushQueueDepth),
+		bodies:   make(map[string]*pendingBody),
+		inflight: make(map[string]context.CancelCauseFunc),
+	}
+	rc.codec.Store(channelCodec(dc))
+
+	// Tell the client when one of its fragmented requests was lost
+	rc.channel.OnError(func(id uint32, err error) {
+		problem := newProblem(http.StatusBadRequest, problemMalformedRequest, err.Error())
+		switch {
+		case errors.Is(err, errMessageTooLarge):
+			problem = newProblem(http.StatusRequestEntityTooLarge, problemTooLarge, err.Error())
+		case errors.Is(err, errTooManyPartials):
+			problem = newProblem(http.StatusTooManyRequests, problemRateLimited, err.Error())
+		}
+		rc.send(problem.With("fragment", id).Response())
+	})
+	rc.channel.OnMessage(rc.handleMessage)
+	go rc.pushEvents()
+	return rc
+}
+
+// serveRESTChannel serves REST requests on dc and greets the client once
+// the channel opens.
+func serveRESTChannel(client *Client, dc *webrtc.DataChannel) channelService {
+	rest := newRestChannel(client.ctx, dc)
+	rest.limiter = client.limiter
+	dc.OnOpen(func() {
+		log.Println("✅ Data channel opened on server side")
+
+		// Send a welcome REST API response
+		welcome := RestAPIResponse{
+			Status:  200,
+			Headers: Header{"Content-Type": {"application/json"}, "Accept-Encoding": {acceptEncodingHeader()}},
+			Body:    map[string]string{"message": "WebRTC REST API Server Ready"},
+		}
+		log.Println("📤 Sending welcome message to data channel")
+		rest.send(welcome)
+	})
+	return rest
+}
+
+// handleMessage processes one complete data channel message: a request
+// envelope, a batch of them, or a frame carrying part of a binary request
+// body. Every request it cannot serve is answered with a problem response.
+func (rc *restChannel) handleMessage(msg webrtc.DataChannelMessage) {
+	var id string
+	defer func() {
+		if r := recover(); r != nil {
+			rc.reply(id, panicResponse(r))
+		}
+	}()
+
+	first := !rc.received.Swap(true)
+	if !msg.IsString && len(msg.Data) > 0 && msg.Data[0] == frameBody {
+		rc.handleBodyFrame(msg.Data)
+		return
+	}
+	if rc.isBatch(msg) {
+		// The batch is charged as a whole before it is decoded, and each
+		// of its requests once more as it runs
+		if wait, ok := rc.allowBatch(); !ok {
+			rc.reply("", rateLimitedResponse(wait))
+			return
+		}
+		rc.handleBatch(msg)
+		return
+	}
+
+	// Parse REST API request. Requests over the rate limit are refused
+	// before they are logged or handled.
+	apiRequest, err := rc.decodeRequest(msg)
+	if wait, ok := rc.allow(apiRequest); !ok {
+		if err != nil {
+			apiRequest.ID = rc.recoverRequestID(msg)
+		}
+		rc.reply(apiRequest.ID, rateLimitedResponse(wait))
+		return
+	}
+
+	switch {
+	case !msg.IsString && len(msg.Data) > 0 && msg.Data[0] == frameEnvelope:
+		log.Printf("📥 Received data channel message: %d-byte binary envelope", len(msg.Data))
+	case len(msg.Data) > fragmentSize:
+		log.Printf("📥 Received data channel message: %d bytes", len(msg.Data))
+	default:
+		log.Printf("📥 Received data channel message: %s", string(msg.Data))
+	}
+
+	if err != nil {
+		log.Println("Failed to parse API request:", err)
+		rc.reply(rc.recoverRequestID(msg), newProblem(http.StatusBadRequest, problemMalformedRequest, "Invalid request envelope: "+err.Error()).Response())
+		return
+	}
+	id = apiRequest.ID
+
+	switch apiRequest.Method {
+	case methodHello:
+		rc.handleHello(apiRequest, first)
+		return
+	case methodCancel:
+		rc.cancelRequest(apiRequest.ID)
+		return
+	case methodSubscribe, methodUnsubscribe:
+		rc.reply(apiRequest.ID, rc.handleSubscription(apiRequest))
+		return
+	}
+	if !requestMethods[strings.ToUpper(apiRequest.Method)] {
+		response := newProblem(http.StatusNotImplemented, problemUnknownMethod, "Unknown method "+apiRequest.Method).Response()
+		response.Headers.Set("Allow", allowedMethods())
+		rc.reply(apiRequest.ID, response)
+		return
+	}
+	if apiRequest.Binary {
+		rc.expectBody(apiRequest)
+		return
+	}
+	rc.dispatch(apiRequest)
+}
+
+// allow charges request to the session's rate limit. CANCEL is free, as it
+// only ever lightens the load.
+func (rc *restChannel) allow(request RestAPIMessage) (time.Duration, bool) {
+	if rc.limiter == nil || request.Method == methodCancel {
+		return 0, true
+	}
+	return rc.limiter.allow(request.Method, request.Endpoint)
+}
+
+// allowBatch charges a batch message to the session's rate limit.
+func (rc *restChannel) allowBatch() (time.Duration, bool) {
+	if rc.limiter == nil {
+		return 0, true
+	}
+	return rc.limiter.allowSession("batch")
+}
+
+// dispatch handles request on its own goroutine so a slow endpoint does not
+// hold up the ones behind it. Responses may therefore go out in a different
+// order; the echoed ID ties them together.
+//
+// The handler's context is cancelled when the request times out, the client
+// sends CANCEL for its ID, or the channel closes. The client gets a 504 or
+// 499 straight away, even if the handler does not notice and keeps running.
+func (rc *restChannel) dispatch(request RestAPIMessage) {
+	if request.Timeout < 0 {
+		rc.reply(request.ID, errorResponse(http.StatusBadRequest, "timeout must be a positive number of milliseconds"))
+		return
+	}
+	if errResp := decompressRequest(&request); errResp != nil {
+		rc.reply(request.ID, *errResp)
+		return
+	}
+	fillRequestHeaders(&request)
+
+	go func() {
+		reqCtx, cancel, ok := rc.track(request.ID)
+		if !ok {
+			rc.reply(request.ID, errorResponse(http.StatusConflict, "A request with this id is already in flight"))
+			return
+		}
+		defer rc.untrack(request.ID, cancel)
+
+		ctx, cancelTimeout := withRequestTimeout(reqCtx, request)
+		defer cancelTimeout()
+
+		response, ok := rc.run(ctx, request)
+		if !ok {
+			return // Nobody left to answer
+		}
+		response.ID = request.ID
+
+		if response.Streamer != nil {
+			// An explicit timeout covers the whole stream; otherwise the
+			// stream runs until it finishes or is cancelled
+			if request.Timeout > 0 {
+				reqCtx = ctx
+			}
+			rc.stream(reqCtx, response)
+			return
+		}
+		rc.send(compressResponse(request, response))
+	}()
+}
+
+// withRequestTimeout bounds ctx by request's timeout, or the default one.
+func withRequestTimeout(ctx context.Context, request RestAPIMessage) (context.Context, context.CancelFunc) {
+	timeout := requestTimeout
+	if request.Timeout > 0 {
+		timeout = time.Duration(request.Timeout) * time.Millisecond
+	}
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, timeout, errRequestTimeout)
+}
+
+// run handles request and returns its response, or a 504 or 499 as soon as
+// ctx ends even if the handler keeps running. It returns false if the
+// channel closed, leaving nobody to answer.
+func (rc *restChannel) run(ctx context.Context, request RestAPIMessage) (RestAPIResponse, bool) {
+	done := make(chan RestAPIResponse, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- panicResponse(r)
+			}
+		}()
+		done <- handleRestAPIRequest(ctx, request)
+	}()
+
+	select {
+	case response := <-done:
+		return response, true
+	case <-ctx.Done():
+		if rc.ctx.Err() != nil {
+			return RestAPIResponse{}, false
+		}
+		log.Printf("Request %s %s aborted: %v", request.Method, request.Endpoint, context.Cause(ctx))
+		return abortedResponse(ctx), true
+	}
+}
+
+// track registers an in-flight request so CANCEL can reach it. Requests
+// without an ID cannot be cancelled and are not tracked.
+func (rc *restChannel) track(id string) (context.Context, context.CancelCauseFunc, bool) {
+	ctx, cancel := context.WithCancelCause(rc.ctx)
+	if id == "" {
+		return ctx, cancel, true
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, exists := rc.inflight[id]; exists {
+		cancel(nil)
+		return nil, nil, false
+	}
+	rc.inflight[id] = cancel
+	return ctx, cancel, true
+}
+
+func (rc *restChannel) untrack(id string, cancel context.CancelCauseFunc) {
+	cancel(nil)
+	if id == "" {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.inflight, id)
+}
+
+// cancelRequest stops the in-flight request or stream with the given ID.
+func (rc *restChannel) cancelRequest(id string) {
+	rc.mu.Lock()
+	cancel, ok := rc.inflight[id]
+	rc.mu.Unlock()
+	if !ok {
+		log.Printf("Nothing to cancel for request %s", id)
+		return
+	}
+	log.Printf("Cancelling request %s", id)
+	cancel(errRequestCancelled)
+}
+
+// abortedResponse answers a request whose context ended before its handler
+// returned.
+func abortedResponse(ctx context.Context) RestAPIResponse {
+	if errors.Is(context.Cause(ctx), errRequestCancelled) {
+		return errorResponse(statusClientClosedRequest, "Request cancelled")
+	}
+	return errorResponse(http.StatusGatewayTimeout, "Request timed out")
+}
+
+// expectBody records a binary request whose body frames are still to come.
+func (rc *restChannel) expectBody(request RestAPIMessage) {
+	if request.ID == "" || len(request.ID) > maxBodyFrameID {
+		rc.reply(request.ID, errorResponse(http.StatusBadRequest, "Binary requests need an id of at most 255 bytes"))
+		return
+	}
+	if request.BodyLength == 0 {
+		request.RawBody = []byte{}
+		rc.dispatch(request)
+		return
+	}
+
+	pending := &pendingBody{request: request}
+	if request.BodyLength < 0 || request.BodyLength > maxMessageSize {
+		// Swallow the frames that follow, but answer straight away
+		pending.discard = true
+		rc.reply(request.ID, newProblem(http.StatusRequestEntityTooLarge, problemTooLarge, "Request body exceeds maximum message size").Response())
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, exists := rc.bodies[request.ID]; exists {
+		go rc.reply(request.ID, errorResponse(http.StatusConflict, "Request id already in use"))
+		return
+	}
+	if len(rc.bodies) >= maxPendingBodies {
+		// Body frames for the request are dropped as unknown
+		if !pending.discard {
+			go rc.reply(request.ID, newProblem(http.StatusTooManyRequests, problemRateLimited,
+				fmt.Sprintf("More than %d request bodies in progress", maxPendingBodies)).Response())
+		}
+		return
+	}
+	pending.timer = time.AfterFunc(reassemblyTimeout, func() {
+		rc.mu.Lock()
+		_, ok := rc.bodies[request.ID]
+		delete(rc.bodies, request.ID)
+		rc.mu.Unlock()
+		if ok && !pending.discard {
+			rc.reply(request.ID, errorResponse(http.StatusRequestTimeout, "Timed out waiting for request body"))
+		}
+	})
+	rc.bodies[request.ID] = pending
+}
+
+// handleBodyFrame appends a body frame to its pending request and dispatches
+// the request once the body is complete.
+func (rc *restChannel) handleBodyFrame(frame []byte) {
+	id, payload, err := parseBodyFrame(frame)
+	if err != nil {
+		log.Printf("Dropping body frame: %v", err)
+		return
+	}
+
+	rc.mu.Lock()
+	pending, ok := rc.bodies[id]
+	if !ok {
+		rc.mu.Unlock()
+		log.Printf("Dropping body frame for unknown request %s", id)
+		return
+	}
+	pending.received += len(payload)
+	if pending.received > pending.request.BodyLength {
+		pending.timer.Stop()
+		delete(rc.bodies, id)
+		rc.mu.Unlock()
+		if !pending.discard {
+			rc.reply(id, errorResponse(http.StatusBadRequest, "Request body longer than bodyLength"))
+		}
+		return
+	}
+	if !pending.discard {
+		// Grown as frames arrive rather than trusting bodyLength up front
+		pending.request.RawBody = append(pending.request.RawBody, payload...)
+	}
+	if pending.received < pending.request.BodyLength {
+		pending.timer.Reset(reassemblyTimeout)
+		rc.mu.Unlock()
+		return
+	}
+	pending.timer.Stop()
+	delete(rc.bodies, id)
+	rc.mu.Unlock()
+
+	if !pending.discard {
+		rc.dispatch(pending.request)
+	}
+}
+
+// reply sends response as the answer to request id.
+func (rc *restChannel) reply(id string, response RestAPIResponse) {
+	response.ID = id
+	rc.send(response)
+}
+
+// send marshals response and sends it over the channel, fragmenting it when
+// it does not fit in a single data channel message. Responses with a RawBody
+// are sent as an envelope followed by body frames instead of inline JSON.
+func (rc *restChannel) send(response RestAPIResponse) {
+	if len(response.RawBody) > maxMessageSize {
+		log.Printf("API response %s too large: %d bytes", response.ID, len(response.RawBody))
+		id := response.ID
+		response = newProblem(http.StatusInternalServerError, problemTooLarge, "Response exceeds maximum message size").Response()
+		response.ID = id
+	}
+	if response.RawBody != nil && len(response.ID) > maxBodyFrameID {
+		// Its body frames could not name the request
+		id := response.ID
+		response = errorResponse(http.StatusBadRequest, fmt.Sprintf("Binary responses need a request id of at most %d bytes", maxBodyFrameID))
+		response.ID = id
+	}
+	fillResponseHeaders(&response)
+	if response.RawBody != nil {
+		if response.ID == "" {
+			log.Printf("Cannot send binary response without a request id")
+			return
+		}
+		response.Binary = true
+		response.BodyLength = len(response.RawBody)
+		response.Body = nil
+	}
+
+	err := rc.sendMessage(response)
+	if errors.Is(err, errMessageTooLarge) {
+		log.Printf("API response %s too large: %v", response.ID, err)
+		tooLarge := newProblem(http.StatusInternalServerError, problemTooLarge, "Response exceeds maximum message size").Response()
+		tooLarge.ID = response.ID
+		err = rc.sendMessage(tooLarge)
+	}
+	if err == nil && response.RawBody != nil {
+		err = rc.sendBody(response.ID, response.RawBody)
+	}
+	if err != nil {
+		log.Printf("Failed to send API response %s: %v", response.ID, err)
+	}
+}
+
+// sendBody sends body as a sequence of body frames for request id.
+func (rc *restChannel) sendBody(id string, body []byte) error {
+	for offset := 0; offset < len(body); {
+		end := min(offset+bodyChunkSize, len(body))
+		if err := rc.channel.Send(bodyFrame(id, body[offset:end])); err != nil {
+			return err
+		}
+		offset = end
+	}
+	return nil
+}
+
+func (rc *restChannel) sendStats() sendQueueStats {
+	return rc.channel.stats()
+}
+
+// close stops running streams, drops the channel's topic subscriptions and
+// discards partially received messages and request bodies.
+func (rc *restChannel) close() {
+	rc.cancel()
+	rc.channel.close()
+	if n := broker.UnsubscribeAll(rc); n > 0 {
+		log.Printf("Removed %d subscriptions of closed data channel", n)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for id, pending := range rc.bodies {
+		pending.timer.Stop()
+		delete(rc.bodies, id)
+	}
+}
+
+func bodyFrame(id string, payload []byte) []byte {
+	frame := make([]byte, 0, 2+len(id)+len(payload))
+	frame = append(frame, frameBody, byte(len(id)))
+	frame = append(frame, id...)
+	return append(frame, payload...)
+}
+
+func parseBodyFrame(frame []byte) (string, []byte, error) {
+	if len(frame) < 2 || len(frame) < 2+int(frame[1]) {
+		return "", nil, errors.New("malformed body frame")
+	}
+	idEnd := 2 + int(frame[1])
+	return string(frame[2:idEnd]), frame[idEnd:], nil
+}
+
+// isBinaryContentType reports whether a body of this type should travel as
+// raw bytes rather than inside the JSON envelope.
+func isBinaryContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "" {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		mediaType == "application/json",
+		strings.HasSuffix(mediaType, "+json"),
+		mediaType == "application/xml",
+		strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/javascript",
+		mediaType == "application/x-www-form-urlencoded":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestBodyFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		payload []byte
+	}{
+		{"short id", "1", []byte("payload")},
+		{"empty payload", "req-7", nil},
+		{"longest id and full chunk", string(bytes.Repeat([]byte("i"), maxBodyFrameID)), bytes.Repeat([]byte{0xff}, bodyChunkSize)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := bodyFrame(tt.id, tt.payload)
+			if len(frame) > fragmentSize {
+				t.Fatalf("frame is %d bytes, more than one %d-byte message", len(frame), fragmentSize)
+			}
+			id, payload, err := parseBodyFrame(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != tt.id || !bytes.Equal(payload, tt.payload) {
+				t.Fatalf("got id %q and %d bytes, want %q and %d", id, len(payload), tt.id, len(tt.payload))
+			}
+		})
+	}
+}
+
+func TestBinaryResponseID(t *testing.T) {
+	defer func(h Handler) { restHandler = h }(restHandler)
+	restHandler = func(req *Request) RestAPIResponse {
+		return RestAPIResponse{Status: http.StatusOK, Headers: Header{"Content-Type": {"image/png"}}, RawBody: []byte("png")}
+	}
+
+	dcA, dcB, _, _ := newPair(t, "binary-id", nil)
+	rc := newRestChannel(context.Background(), dcB)
+	defer rc.close()
+	replies := make(chan webrtc.DataChannelMessage, 4)
+	dcA.OnMessage(func(msg webrtc.DataChannelMessage) { replies <- msg })
+
+	tests := []struct {
+		name       string
+		id         string
+		wantStatus int
+		wantBinary bool
+	}{
+		{"longest id", strings.Repeat("a", maxBodyFrameID), http.StatusOK, true},
+		{"id too long for a body frame", strings.Repeat("b", maxBodyFrameID+1), http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, _ := json.Marshal(RestAPIMessage{ID: tt.id, Method: "GET", Endpoint: "/image"})
+			if err := dcA.SendText(string(request)); err != nil {
+				t.Fatal(err)
+			}
+			var response RestAPIResponse
+			select {
+			case msg := <-replies:
+				if err := json.Unmarshal(msg.Data, &response); err != nil {
+					t.Fatalf("reply %s: %v", msg.Data, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("request never answered")
+			}
+			if response.ID != tt.id || response.Status != tt.wantStatus || response.Binary != tt.wantBinary {
+				t.Fatalf("got id of %d bytes, status %d, binary %v; want %d bytes, %d, %v",
+					len(response.ID), response.Status, response.Binary, len(tt.id), tt.wantStatus, tt.wantBinary)
+			}
+			if !tt.wantBinary {
+				return
+			}
+			select {
+			case msg := <-replies:
+				id, payload, err := parseBodyFrame(msg.Data)
+				if err != nil || id != tt.id || string(payload) != "png" {
+					t.Fatalf("body frame for id of %d bytes with %q, err %v", len(id), payload, err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("body never arrived")
+			}
+		})
+	}
+}
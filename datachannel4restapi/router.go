@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Request is a data channel request as seen by a routed Handler: the
+// envelope plus its parsed path, query string and path parameters.
+type Request struct {
+	RestAPIMessage
+	Path   string
+	Query  url.Values
+	Params map[string]string
+
+	ctx context.Context
+}
+
+// Context returns the request's context. It is cancelled when the request
+// times out, the client cancels it, or the session ends.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a shallow copy of r with its context replaced by ctx.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+	return r2
+}
+
+// newRequest wraps request for the middleware that runs before it is
+// routed. Path and Query are left empty if the endpoint does not parse;
+// the router reports that.
+func newRequest(ctx context.Context, request RestAPIMessage) *Request {
+	req := &Request{RestAPIMessage: request, ctx: ctx}
+	if u, err := url.Parse(request.Endpoint); err == nil {
+		req.Path = u.Path
+		req.Query, _ = url.ParseQuery(u.RawQuery)
+	}
+	return req
+}
+
+// Param returns the value of the path parameter name, or "".
+func (r *Request) Param(name string) string {
+	return r.Params[name]
+}
+
+// Handler serves a routed data channel request.
+type Handler func(req *Request) RestAPIResponse
+
+// route is one registered pattern such as /api/users/{id}.
+type route struct {
+	method   string
+	pattern  string
+	segments []string
+	handler  Handler
+}
+
+// Router dispatches requests by method and path pattern. Pattern segments
+// written as {name} match any single path segment and are exposed to the
+// handler through Request.Param.
+type Router struct {
+	routes []route
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers h for method requests whose path matches pattern.
+func (r *Router) Handle(method, pattern string, h Handler) {
+	r.routes = append(r.routes, route{
+		method:   strings.ToUpper(method),
+		pattern:  pattern,
+		segments: splitPath(pattern),
+		handler:  h,
+	})
+	// Try routes with more literal segments first, so /api/users/me wins
+	// over /api/users/{id}
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return literalSegments(r.routes[i].segments) > literalSegments(r.routes[j].segments)
+	})
+}
+
+// Serve routes request to the matching handler. Unknown paths answer 404;
+// known paths requested with an unregistered method answer 405 with an
+// Allow header listing the registered ones.
+func (r *Router) Serve(ctx context.Context, request RestAPIMessage) RestAPIResponse {
+	u, err := url.Parse(request.Endpoint)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "Invalid endpoint")
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "Invalid query string")
+	}
+	segments := splitPath(u.EscapedPath())
+	for i, segment := range segments {
+		if segments[i], err = url.PathUnescape(segment); err != nil {
+			return errorResponse(http.StatusBadRequest, "Invalid endpoint")
+		}
+	}
+
+	method := strings.ToUpper(request.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var allowed []string
+	for _, rt := range r.routes {
+		params, ok := matchSegments(rt.segments, segments)
+		if !ok {
+			continue
+		}
+		if rt.method != method {
+			allowed = append(allowed, rt.method)
+			continue
+		}
+		return rt.handler(&Request{
+			RestAPIMessage: request,
+			Path:           u.Path,
+			Query:          query,
+			Params:         params,
+			ctx:            ctx,
+		})
+	}
+
+	if len(allowed) > 0 {
+		slices.Sort(allowed)
+		allowed = slices.Compact(allowed)
+		response := errorResponse(http.StatusMethodNotAllowed, "Method not allowed")
+		response.Headers.Set("Allow", strings.Join(allowed, ", "))
+		return response
+	}
+	return newProblem(http.StatusNotFound, "", "Endpoint not found").With("endpoint", request.Endpoint).Response()
+}
+
+// matchSegments matches a request path against a route pattern, returning
+// the values of the pattern's {name} segments.
+func matchSegments(pattern, path []string) (map[string]string, bool) {
+	if len(pattern) != len(path) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, segment := range pattern {
+		if name, ok := paramName(segment); ok {
+			if path[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[name] = path[i]
+			continue
+		}
+		if segment != path[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func paramName(segment string) (string, bool) {
+	if len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+func literalSegments(segments []string) int {
+	n := 0
+	for _, segment := range segments {
+		if _, ok := paramName(segment); !ok {
+			n++
+		}
+	}
+	return n
+}
+
+// splitPath splits a path into segments, ignoring a trailing slash.
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern    string
+		path       string
+		wantParams map[string]string
+		wantOK     bool
+	}{
+		{"/api/users", "/api/users", nil, true},
+		{"/api/users", "/api/users/", nil, true},
+		{"/api/users", "/api/user", nil, false},
+		{"/api/users", "/api/users/1", nil, false},
+		{"/api/users/{id}", "/api/users/42", map[string]string{"id": "42"}, true},
+		{"/api/users/{id}", "/api/users", nil, false},
+		{"/api/users/{id}", "/api/users//", nil, false},
+		{"/api/{kind}/{id}", "/api/orders/7", map[string]string{"kind": "orders", "id": "7"}, true},
+		{"/api/{}/x", "/api/{}/x", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			params, ok := matchSegments(splitPath(tt.pattern), splitPath(tt.path))
+			if ok != tt.wantOK || !reflect.DeepEqual(params, tt.wantParams) {
+				t.Fatalf("got %v, %v; want %v, %v", params, ok, tt.wantParams, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRouterServe(t *testing.T) {
+	r := NewRouter()
+	named := func(name string) Handler {
+		return func(req *Request) RestAPIResponse {
+			return jsonResponse(http.StatusOK, map[string]interface{}{
+				"handler": name,
+				"params":  req.Params,
+				"query":   req.Query.Get("q"),
+			})
+		}
+	}
+	r.Handle("GET", "/api/users", named("list"))
+	r.Handle("POST", "/api/users", named("create"))
+	r.Handle("GET", "/api/users/{id}", named("get"))
+	r.Handle("DELETE", "/api/users/{id}", named("delete"))
+	r.Handle("GET", "/api/users/me", named("me"))
+
+	tests := []struct {
+		name        string
+		method      string
+		endpoint    string
+		wantStatus  int
+		wantHandler string
+		wantParams  map[string]string
+		wantQuery   string
+		wantAllow   string
+	}{
+		{name: "literal", method: "GET", endpoint: "/api/users", wantStatus: 200, wantHandler: "list"},
+		{name: "method defaults to GET", endpoint: "/api/users", wantStatus: 200, wantHandler: "list"},
+		{name: "method is case-insensitive", method: "post", endpoint: "/api/users", wantStatus: 200, wantHandler: "create"},
+		{name: "parameter", method: "GET", endpoint: "/api/users/7", wantStatus: 200, wantHandler: "get", wantParams: map[string]string{"id": "7"}},
+		{name: "literal beats parameter", method: "GET", endpoint: "/api/users/me", wantStatus: 200, wantHandler: "me"},
+		{name: "escaped parameter", method: "GET", endpoint: "/api/users/a%2Fb", wantStatus: 200, wantHandler: "get", wantParams: map[string]string{"id": "a/b"}},
+		{name: "query", method: "GET", endpoint: "/api/users?q=ann", wantStatus: 200, wantHandler: "list", wantQuery: "ann"},
+		{name: "trailing slash", method: "GET", endpoint: "/api/users/", wantStatus: 200, wantHandler: "list"},
+		{name: "method not allowed", method: "PUT", endpoint: "/api/users/7", wantStatus: 405, wantAllow: "DELETE, GET"},
+		{name: "not found", method: "GET", endpoint: "/api/orders", wantStatus: 404},
+		{name: "invalid query", method: "GET", endpoint: "/api/users?q=%zz", wantStatus: 400},
+		{name: "invalid escape", method: "GET", endpoint: "/api/users/%zz", wantStatus: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := r.Serve(context.Background(), RestAPIMessage{Method: tt.method, Endpoint: tt.endpoint})
+			if response.Status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", response.Status, tt.wantStatus)
+			}
+			if allow := response.Headers.Get("Allow"); allow != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", allow, tt.wantAllow)
+			}
+			if tt.wantHandler == "" {
+				return
+			}
+			body := response.Body.(map[string]interface{})
+			if body["handler"] != tt.wantHandler {
+				t.Errorf("handler = %v, want %s", body["handler"], tt.wantHandler)
+			}
+			if params := body["params"].(map[string]string); !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("params = %v, want %v", params, tt.wantParams)
+			}
+			if body["query"] != tt.wantQuery {
+				t.Errorf("query = %v, want %q", body["query"], tt.wantQuery)
+			}
+		})
+	}
+}
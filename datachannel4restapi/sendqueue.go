@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Outgoing messages wait in a per-channel send queue instead of piling up in
+// pion's SCTP buffer. The queue's writer stops while more than sendHighWater
+// bytes are buffered, and resumes once OnBufferedAmountLow reports that the
+// buffer has drained to half of that. Producers block while the queue is
+// full, so a handler that outpaces the channel is slowed down rather than
+// buffered without bound.
+var (
+	sendHighWater  = 1 << 20
+	sendQueueDepth = 64
+)
+
+var errChannelClosed = errors.New("data channel closed")
+
+type outgoingMessage struct {
+	data []byte
+	text bool
+}
+
+// sendQueueStats describes a send queue. Queued counts messages waiting in
+// the queue, Buffered the bytes pion has yet to transmit.
+type sendQueueStats struct {
+	Queued   int    `json:"queued"`
+	Buffered uint64 `json:"buffered"`
+	Sent     uint64 `json:"sent"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+func (s sendQueueStats) add(other sendQueueStats) sendQueueStats {
+	return sendQueueStats{
+		Queued:   s.Queued + other.Queued,
+		Buffered: s.Buffered + other.Buffered,
+		Sent:     s.Sent + other.Sent,
+		Dropped:  s.Dropped + other.Dropped,
+	}
+}
+
+// sendQueue is the only writer of its data channel.
+type sendQueue struct {
+	dc    *webrtc.DataChannel
+	queue chan outgoingMessage
+	low   chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	sent    atomic.Uint64
+	dropped atomic.Uint64
+}
+
+func newSendQueue(dc *webrtc.DataChannel) *sendQueue {
+	q := &sendQueue{
+		dc:    dc,
+		queue: make(chan outgoingMessage, sendQueueDepth),
+		low:   make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	dc.SetBufferedAmountLowThreshold(uint64(sendHighWater / 2))
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case q.low <- struct{}{}:
+		default:
+		}
+	})
+	go q.run()
+	return q
+}
+
+// send queues a message, waiting while the queue is full. It fails only
+// once the queue is closed.
+func (q *sendQueue) send(data []byte, text bool) error {
+	select {
+	case <-q.done:
+		q.dropped.Add(1)
+		return errChannelClosed
+	default:
+	}
+	select {
+	case q.queue <- outgoingMessage{data: data, text: text}:
+		return nil
+	case <-q.done:
+		q.dropped.Add(1)
+		return errChannelClosed
+	}
+}
+
+// trySend queues a message unless the queue is full, in which case the
+// message is dropped. It suits messages a slow reader can do without, so
+// one slow channel does not hold up the others.
+func (q *sendQueue) trySend(data []byte, text bool) bool {
+	select {
+	case <-q.done:
+	case q.queue <- outgoingMessage{data: data, text: text}:
+		return true
+	default:
+	}
+	q.dropped.Add(1)
+	return false
+}
+
+func (q *sendQueue) run() {
+	for {
+		select {
+		case <-q.done:
+			q.discard()
+			return
+		case msg := <-q.queue:
+			if !q.waitForRoom() {
+				q.dropped.Add(1)
+				q.discard()
+				return
+			}
+			var err error
+			if msg.text {
+				err = q.dc.SendText(string(msg.data))
+			} else {
+				err = q.dc.Send(msg.data)
+			}
+			if err != nil {
+				q.dropped.Add(1)
+				log.Printf("Failed to send on %s: %v", q.dc.Label(), err)
+				if q.dc.ReadyState() != webrtc.DataChannelStateOpen {
+					// Nothing more will get through
+					q.close()
+				}
+				continue
+			}
+			q.sent.Add(1)
+		}
+	}
+}
+
+// waitForRoom waits until pion's buffer is below the high-water mark. It
+// returns false if the queue closes first.
+func (q *sendQueue) waitForRoom() bool {
+	select {
+	case <-q.done:
+		return false
+	default:
+	}
+	for q.dc.BufferedAmount() > uint64(sendHighWater) {
+		select {
+		case <-q.low:
+		case <-q.done:
+			return false
+		}
+	}
+	return true
+}
+
+// discard drops every message still queued once the queue has closed.
+func (q *sendQueue) discard() {
+	for {
+		select {
+		case <-q.queue:
+			q.dropped.Add(1)
+		default:
+			if dropped := q.dropped.Load(); dropped > 0 {
+				log.Printf("Send queue of %s closed after %d messages, %d dropped", q.dc.Label(), q.sent.Load(), dropped)
+			}
+			return
+		}
+	}
+}
+
+func (q *sendQueue) stats() sendQueueStats {
+	return sendQueueStats{
+		Queued:   len(q.queue),
+		Buffered: q.dc.BufferedAmount(),
+		Sent:     q.sent.Load(),
+		Dropped:  q.dropped.Load(),
+	}
+}
+
+// close stops the writer, dropping whatever is still queued, and releases
+// producers waiting for room.
+func (q *sendQueue) close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errUserNotFound = errors.New("user not found")
+	errEmailTaken   = errors.New("email already in use")
+)
+
+// User is the resource served under /api/users.
+type User struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// UserStore persists users. Implementations must be safe for concurrent use
+// and keep email addresses unique, case-insensitively.
+type UserStore interface {
+	// List returns all users ordered by ID.
+	List() ([]User, error)
+	// Get returns the user with the given ID or errUserNotFound.
+	Get(id int) (User, error)
+	// Create assigns the user an ID and timestamps and stores it.
+	Create(user User) (User, error)
+	// Update calls change with a copy of the user with the given ID and
+	// stores the result. change runs while the store is locked, so
+	// concurrent updates of one user cannot overwrite each other. An error
+	// from change is returned as is and leaves the user untouched.
+	Update(id int, change func(user *User) error) (User, error)
+	// Delete removes the user with the given ID.
+	Delete(id int) error
+}
+
+// MemoryUserStore keeps users in memory; they are lost on restart.
+type MemoryUserStore struct {
+	mu     sync.RWMutex
+	users  map[int]User
+	nextID int
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: make(map[int]User), nextID: 1}
+}
+
+func (s *MemoryUserStore) List() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sorted(), nil
+}
+
+func (s *MemoryUserStore) Get(id int) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[id]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	return user, nil
+}
+
+func (s *MemoryUserStore) Create(user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.emailTaken(user.Email, 0) {
+		return User{}, errEmailTaken
+	}
+	now := time.Now().UTC()
+	user.ID = s.nextID
+	user.CreatedAt, user.UpdatedAt = now, now
+	s.users[user.ID] = user
+	s.nextID++
+	return user, nil
+}
+
+func (s *MemoryUserStore) Update(id int, change func(user *User) error) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.users[id]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	user := existing
+	if err := change(&user); err != nil {
+		return User{}, err
+	}
+	if s.emailTaken(user.Email, id) {
+		return User{}, errEmailTaken
+	}
+	user.ID = id
+	user.CreatedAt = existing.CreatedAt
+	user.UpdatedAt = time.Now().UTC()
+	s.users[user.ID] = user
+	return user, nil
+}
+
+func (s *MemoryUserStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[id]; !ok {
+		return errUserNotFound
+	}
+	delete(s.users, id)
+	return nil
+}
+
+func (s *MemoryUserStore) emailTaken(email string, exceptID int) bool {
+	for id, user := range s.users {
+		if id != exceptID && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryUserStore) sorted() []User {
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+// userFile is the on-disk format of FileUserStore.
+type userFile struct {
+	NextID int    `json:"nextId"`
+	Users  []User `json:"users"`
+}
+
+// FileUserStore is a MemoryUserStore that writes every change to a JSON file
+// so users survive restarts.
+type FileUserStore struct {
+	*MemoryUserStore
+	path string
+	// existed tells whether the file was there when the store was opened
+	existed bool
+	// mu serialises change-and-save so the file never goes backwards
+	mu sync.Mutex
+}
+
+// NewFileUserStore loads users from path. A missing file starts an empty
+// store; the file is created on the first change.
+func NewFileUserStore(path string) (*FileUserStore, error) {
+	s := &FileUserStore{MemoryUserStore: NewMemoryUserStore(), path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.existed = true
+	var file userFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, user := range file.Users {
+		s.users[user.ID] = user
+		s.nextID = max(s.nextID, user.ID+1)
+	}
+	s.nextID = max(s.nextID, file.NextID)
+	return s, nil
+}
+
+func (s *FileUserStore) Create(user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	created, err := s.MemoryUserStore.Create(user)
+	if err != nil {
+		return User{}, err
+	}
+	if err := s.save(); err != nil {
+		s.MemoryUserStore.Delete(created.ID)
+		return User{}, err
+	}
+	return created, nil
+}
+
+func (s *FileUserStore) Update(id int, change func(user *User) error) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, err := s.MemoryUserStore.Get(id)
+	if err != nil {
+		return User{}, err
+	}
+	updated, err := s.MemoryUserStore.Update(id, change)
+	if err != nil {
+		return User{}, err
+	}
+	if err := s.save(); err != nil {
+		s.restore(previous)
+		return User{}, err
+	}
+	return updated, nil
+}
+
+func (s *FileUserStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, err := s.MemoryUserStore.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := s.MemoryUserStore.Delete(id); err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		s.restore(previous)
+		return err
+	}
+	return nil
+}
+
+// restore puts back a user whose change could not be saved.
+func (s *FileUserStore) restore(user User) {
+	s.MemoryUserStore.mu.Lock()
+	defer s.MemoryUserStore.mu.Unlock()
+	s.users[user.ID] = user
+}
+
+// save atomically replaces the file with the current contents of the store.
+func (s *FileUserStore) save() error {
+	s.MemoryUserStore.mu.RLock()
+	data, err := json.MarshalIndent(userFile{NextID: s.nextID, Users: s.sorted()}, "", "  ")
+	s.MemoryUserStore.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// seedUsers adds the demo users to a new store.
+func seedUsers(store UserStore) error {
+	for _, user := range []User{
+		{Name: "John Doe", Email: "john@example.com"},
+		{Name: "Jane Smith", Email: "jane@example.com"},
+	} {
+		if _, err := store.Create(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A streamed response is sent as its RestAPIResponse envelope with stream
+// set to "begin", followed by any number of "data" StreamMessages and a
+// single "end" StreamMessage, all carrying the request ID.
+const (
+	streamBegin = "begin"
+	streamData  = "data"
+	streamEnd   = "end"
+)
+
+// methodCancel asks the server to stop the in-flight request or stream whose
+// ID the CANCEL message carries.
+const methodCancel = "CANCEL"
+
+// StreamMessage carries one chunk of a streamed response, or its end marker.
+type StreamMessage struct {
+	ID     string      `json:"id"`
+	Stream string      `json:"stream"`
+	Seq    int         `json:"seq,omitempty"`
+	Body   interface{} `json:"body,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// StreamFunc produces the body of a streamed response. ctx is cancelled when
+// the client cancels the request or the data channel closes; the stream ends
+// when the function returns.
+type StreamFunc func(ctx context.Context, w *StreamWriter) error
+
+// StreamWriter sends body chunks for one streamed response.
+type StreamWriter struct {
+	rc  *restChannel
+	ctx context.Context
+	id  string
+	seq int
+}
+
+// Send emits body as the next chunk of the stream. It fails once the stream
+// has been cancelled.
+func (w *StreamWriter) Send(body interface{}) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	w.seq++
+	return w.rc.sendMessage(StreamMessage{ID: w.id, Stream: streamData, Seq: w.seq, Body: body})
+}
+
+// stream sends the header of a streamed response and runs its producer until
+// it finishes or ctx ends, then sends the end marker.
+func (rc *restChannel) stream(ctx context.Context, response RestAPIResponse) {
+	id := response.ID
+	if id == "" {
+		rc.send(errorResponse(http.StatusBadRequest, "Streamed responses need a request id"))
+		return
+	}
+
+	response.Stream = streamBegin
+	rc.send(response)
+
+	w := &StreamWriter{rc: rc, ctx: ctx, id: id}
+	err := runStream(ctx, response.Streamer, w)
+
+	end := StreamMessage{ID: id, Stream: streamEnd, Seq: w.seq + 1}
+	switch cause := context.Cause(ctx); {
+	case errors.Is(cause, errRequestCancelled):
+		end.Error = "cancelled"
+	case errors.Is(cause, errRequestTimeout):
+		end.Error = "timed out"
+	case ctx.Err() != nil:
+		end.Error = "closed"
+	case err != nil:
+		end.Error = err.Error()
+	}
+	log.Printf("Stream %s ended after %d chunks", id, w.seq)
+	if err := rc.sendMessage(end); err != nil {
+		log.Printf("Failed to end stream %s: %v", id, err)
+	}
+}
+
+// runStream runs a stream producer, turning a panic into an error so the
+// stream still ends.
+func runStream(ctx context.Context, producer StreamFunc, w *StreamWriter) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic(r)
+			err = errors.New("internal error")
+		}
+	}()
+	return producer(ctx, w)
+}
+
+// sendMessage encodes v in the channel's envelope encoding and sends it.
+func (rc *restChannel) sendMessage(v interface{}) error {
+	if codec := rc.codec.Load(); codec != nil {
+		data, err := codec.encode(v)
+		if err != nil {
+			return err
+		}
+		return rc.channel.Send(data)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return rc.channel.SendText(data)
+}
+
+// progressStream reports the progress of a simulated long-running job.
+func progressStream(ctx context.Context, w *StreamWriter) error {
+	ticker := time.NewTicker(300 * time.Millisecond)
+	defer ticker.Stop()
+
+	for percent := 0; percent <= 100; percent += 5 {
+		if err := w.Send(map[string]interface{}{"percent": percent, "time": time.Now().Format(time.RFC3339Nano)}); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
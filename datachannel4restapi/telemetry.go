@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// telemetryLabel is the data channel label metrics are reported on, by the
+// client and, when serverTelemetryInterval is set, by the server.
+//
+// Telemetry channels are usually opened with ordered false and
+// maxRetransmits or maxPacketLifeTime, since a retransmitted reading is
+// already stale. Messages are never answered, and samples carrying a
+// sequence number older than the newest one seen for their metric are
+// dropped.
+const telemetryLabel = "telemetry"
+
+// serverTelemetryInterval is how often the server reports its own metrics
+// on an unordered telemetry channel it opens toward each client. Zero means
+// it opens none.
+var serverTelemetryInterval time.Duration
+
+// serverTelemetryRetransmits and serverTelemetryLifetime limit how hard
+// the server's telemetry channel retries a lost message. A non-zero
+// lifetime takes precedence, as a channel may only set one of them.
+var (
+	serverTelemetryRetransmits uint
+	serverTelemetryLifetime    time.Duration
+)
+
+// maxTelemetryMetrics caps the distinct metrics a telemetry channel keeps.
+// Samples of further metrics are dropped.
+const maxTelemetryMetrics = 256
+
+// telemetryBacklog is how much may already wait in the server's telemetry
+// channel before a report is skipped rather than queued behind stale ones.
+const telemetryBacklog = 64 * 1024
+
+// TelemetrySample is one metric reading. Time is in milliseconds since the
+// Unix epoch; samples without one are stamped on arrival. Seq increases
+// with each report, so late samples can be told apart.
+type TelemetrySample struct {
+	Metric string  `json:"metric"`
+	Value  float64 `json:"value"`
+	Time   int64   `json:"time,omitempty"`
+	Seq    uint64  `json:"seq,omitempty"`
+}
+
+// telemetryChannel keeps the latest value of each metric a session reports.
+type telemetryChannel struct {
+	from     string
+	reliable bool
+
+	mu       sync.Mutex
+	latest   map[string]TelemetrySample
+	received int
+	dropped  int
+	full     bool // latest holds maxTelemetryMetrics
+}
+
+// serveTelemetryChannel records samples arriving on dc. A message holds one
+// sample or an array of them; malformed messages are dropped, as telemetry
+// is never answered.
+func serveTelemetryChannel(client *Client, dc *webrtc.DataChannel) channelService {
+	tc := &telemetryChannel{from: client.id, reliable: isReliable(dc), latest: make(map[string]TelemetrySample)}
+	if !tc.reliable {
+		log.Printf("Telemetry from %s is unreliable (ordered %v), dropping stale samples", tc.from, dc.Ordered())
+	}
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		samples, err := parseTelemetry(msg.Data)
+		if err != nil {
+			log.Printf("Dropped telemetry from %s: %v", tc.from, err)
+			return
+		}
+		tc.record(samples)
+	})
+	return tc
+}
+
+func parseTelemetry(data []byte) ([]TelemetrySample, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var samples []TelemetrySample
+		err := json.Unmarshal(data, &samples)
+		return samples, err
+	}
+	var sample TelemetrySample
+	if err := json.Unmarshal(data, &sample); err != nil {
+		return nil, err
+	}
+	return []TelemetrySample{sample}, nil
+}
+
+// record keeps each sample unless a newer one of its metric was already
+// recorded, or it names a new metric when the channel already keeps
+// maxTelemetryMetrics. Samples without a sequence number always replace the
+// last one.
+func (tc *telemetryChannel) record(samples []TelemetrySample) {
+	now := time.Now().UnixMilli()
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for _, sample := range samples {
+		if sample.Metric == "" {
+			continue
+		}
+		last, ok := tc.latest[sample.Metric]
+		if ok && sample.Seq != 0 && sample.Seq <= last.Seq {
+			tc.dropped++
+			continue
+		}
+		if !ok && len(tc.latest) >= maxTelemetryMetrics {
+			if !tc.full {
+				tc.full = true
+				log.Printf("Telemetry from %s reports more than %d metrics, dropping new ones", tc.from, maxTelemetryMetrics)
+			}
+			tc.dropped++
+			continue
+		}
+		if sample.Time == 0 {
+			sample.Time = now
+		}
+		tc.latest[sample.Metric] = sample
+		tc.received++
+	}
+}
+
+func (tc *telemetryChannel) close() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	log.Printf("Telemetry from %s closed after %d samples of %d metrics (%d dropped)", tc.from, tc.received, len(tc.latest), tc.dropped)
+}
+
+// serverTelemetryInit describes the channel the server reports on.
+func serverTelemetryInit() *webrtc.DataChannelInit {
+	ordered := false
+	init := &webrtc.DataChannelInit{Ordered: &ordered}
+	if serverTelemetryLifetime > 0 {
+		lifetime := uint16(min(serverTelemetryLifetime.Milliseconds(), 0xffff))
+		init.MaxPacketLifeTime = &lifetime
+	} else {
+		retransmits := uint16(min(serverTelemetryRetransmits, 0xffff))
+		init.MaxRetransmits = &retransmits
+	}
+	return init
+}
+
+// telemetryFeed reports the server's metrics to one client.
+type telemetryFeed struct {
+	client *Client
+	dc     *webrtc.DataChannel
+	out    *sendQueue
+	ctx    context.Context
+	cancel context.CancelFunc
+	seq    uint64
+}
+
+// openTelemetryChannel opens an unordered telemetry channel toward the
+// client and reports on it every serverTelemetryInterval.
+func (c *Client) openTelemetryChannel() {
+	dc, err := c.peerConn.CreateDataChannel(telemetryLabel, serverTelemetryInit())
+	if err != nil {
+		log.Printf("Failed to open telemetry channel: %v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	feed := &telemetryFeed{client: c, dc: dc, out: newSendQueue(dc), ctx: ctx, cancel: cancel}
+	dc.OnOpen(func() {
+		log.Printf("📈 Reporting server telemetry to %s every %v", c.id, serverTelemetryInterval)
+		go feed.run()
+	})
+	c.trackChannel(dc, feed)
+}
+
+func (f *telemetryFeed) run() {
+	ticker := time.NewTicker(serverTelemetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-ticker.C:
+			f.report()
+		}
+	}
+}
+
+// report sends one reading of every metric, fire and forget. It skips the
+// reading when earlier ones are still waiting to be sent.
+func (f *telemetryFeed) report() {
+	if f.dc.BufferedAmount() > telemetryBacklog {
+		return
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	queues := f.client.sendStats()
+	f.seq++
+	now := time.Now().UnixMilli()
+	samples := []TelemetrySample{
+		{Metric: "goroutines", Value: float64(runtime.NumGoroutine())},
+		{Metric: "heap_bytes", Value: float64(mem.HeapAlloc)},
+		{Metric: "channels", Value: float64(f.client.channelCount())},
+		{Metric: "send_queued", Value: float64(queues.Queued)},
+		{Metric: "send_dropped", Value: float64(queues.Dropped)},
+	}
+	for i := range samples {
+		samples[i].Time = now
+		samples[i].Seq = f.seq
+	}
+	data, err := json.Marshal(samples)
+	if err != nil {
+		log.Printf("Failed to encode telemetry: %v", err)
+		return
+	}
+	// Samples are dropped while the channel is backed up; the next report
+	// supersedes them anyway
+	f.out.trySend(data, true)
+}
+
+func (f *telemetryFeed) sendStats() sendQueueStats {
+	return f.out.stats()
+}
+
+func (f *telemetryFeed) close() {
+	f.cancel()
+	f.out.close()
+}
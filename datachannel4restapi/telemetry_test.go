@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTelemetryRecord(t *testing.T) {
+	metrics := func(n int) []TelemetrySample {
+		samples := make([]TelemetrySample, n)
+		for i := range samples {
+			samples[i] = TelemetrySample{Metric: fmt.Sprintf("m%d", i), Value: 1}
+		}
+		return samples
+	}
+	tests := []struct {
+		name         string
+		reports      [][]TelemetrySample
+		wantMetrics  int
+		wantReceived int
+		wantDropped  int
+	}{
+		{
+			name:         "newer seq replaces",
+			reports:      [][]TelemetrySample{{{Metric: "rtt", Seq: 1}}, {{Metric: "rtt", Seq: 2}}},
+			wantMetrics:  1,
+			wantReceived: 2,
+		},
+		{
+			name:         "stale seq dropped",
+			reports:      [][]TelemetrySample{{{Metric: "rtt", Seq: 2}}, {{Metric: "rtt", Seq: 1}}, {{Metric: "rtt", Seq: 2}}},
+			wantMetrics:  1,
+			wantReceived: 1,
+			wantDropped:  2,
+		},
+		{
+			name:         "unnamed sample ignored",
+			reports:      [][]TelemetrySample{{{Value: 3}}},
+			wantMetrics:  0,
+			wantReceived: 0,
+		},
+		{
+			name:         "new metrics over the limit dropped",
+			reports:      [][]TelemetrySample{metrics(maxTelemetryMetrics + 10)},
+			wantMetrics:  maxTelemetryMetrics,
+			wantReceived: maxTelemetryMetrics,
+			wantDropped:  10,
+		},
+		{
+			name:         "known metrics still update at the limit",
+			reports:      [][]TelemetrySample{metrics(maxTelemetryMetrics + 1), metrics(1)},
+			wantMetrics:  maxTelemetryMetrics,
+			wantReceived: maxTelemetryMetrics + 1,
+			wantDropped:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := &telemetryChannel{from: "test", latest: make(map[string]TelemetrySample)}
+			for _, samples := range tt.reports {
+				tc.record(samples)
+			}
+			if len(tc.latest) != tt.wantMetrics || tc.received != tt.wantReceived || tc.dropped != tt.wantDropped {
+				t.Fatalf("metrics %d received %d dropped %d, want %d %d %d",
+					len(tc.latest), tc.received, tc.dropped, tt.wantMetrics, tt.wantReceived, tt.wantDropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxUserNameLength bounds User.Name, in characters.
+const maxUserNameLength = 100
+
+// errInvalidUser stops an update whose input failed validation.
+var errInvalidUser = errors.New("invalid user input")
+
+// userStore backs the /api/users endpoints. main replaces it with a
+// FileUserStore when -users-file is set.
+var userStore UserStore = NewMemoryUserStore()
+
+// userInput is the writable part of a User as sent by clients. Pointers
+// tell an absent field apart from an empty one for PATCH.
+type userInput struct {
+	Name  *string `json:"name"`
+	Email *string `json:"email"`
+}
+
+// registerUserMethods exposes the user routes as JSON-RPC methods, e.g.
+// {"method": "users.get", "params": {"id": 1}}.
+func registerUserMethods(s *JSONRPCServer) {
+	s.HandleRoute("users.list", "GET", "/api/users")
+	s.HandleRoute("users.create", "POST", "/api/users")
+	s.HandleRoute("users.get", "GET", "/api/users/{id}")
+	s.HandleRoute("users.replace", "PUT", "/api/users/{id}")
+	s.HandleRoute("users.update", "PATCH", "/api/users/{id}")
+	s.HandleRoute("users.delete", "DELETE", "/api/users/{id}")
+}
+
+func listUsers(req *Request) RestAPIResponse {
+	users, err := userStore.List()
+	if err != nil {
+		return storeError(err)
+	}
+
+	offset, err := queryInt(req, "offset", 0)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error())
+	}
+	limit, err := queryInt(req, "limit", len(users))
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, err.Error())
+	}
+	users = users[min(offset, len(users)):]
+	users = users[:min(limit, len(users))]
+
+	return jsonResponse(http.StatusOK, users)
+}
+
+func getUser(req *Request) RestAPIResponse {
+	id, errResp := userID(req)
+	if errResp != nil {
+		return *errResp
+	}
+	user, err := userStore.Get(id)
+	if err != nil {
+		return storeError(err)
+	}
+	return jsonResponse(http.StatusOK, user)
+}
+
+func createUser(req *Request) RestAPIResponse {
+	input, errResp := decodeUserInput(req)
+	if errResp != nil {
+		return *errResp
+	}
+	var user User
+	if errResp := applyUserInput(&user, input, true); errResp != nil {
+		return *errResp
+	}
+
+	user, err := userStore.Create(user)
+	if err != nil {
+		return storeError(err)
+	}
+	log.Printf("Created user %d", user.ID)
+	broker.Publish("/api/users", "created", user)
+
+	response := jsonResponse(http.StatusCreated, user)
+	response.Headers.Set("Location", "/api/users/"+strconv.Itoa(user.ID))
+	return response
+}
+
+func replaceUser(req *Request) RestAPIResponse {
+	return updateUser(req, true)
+}
+
+func patchUser(req *Request) RestAPIResponse {
+	return updateUser(req, false)
+}
+
+// updateUser handles PUT (every field required) and PATCH (only the fields
+// present are changed).
+func updateUser(req *Request, replace bool) RestAPIResponse {
+	id, errResp := userID(req)
+	if errResp != nil {
+		return *errResp
+	}
+	input, errResp := decodeUserInput(req)
+	if errResp != nil {
+		return *errResp
+	}
+	var invalid *RestAPIResponse
+	user, err := userStore.Update(id, func(user *User) error {
+		if invalid = applyUserInput(user, input, replace); invalid != nil {
+			return errInvalidUser
+		}
+		return nil
+	})
+	if invalid != nil {
+		return *invalid
+	}
+	if err != nil {
+		return storeError(err)
+	}
+	log.Printf("Updated user %d", user.ID)
+	broker.Publish("/api/users", "updated", user)
+	return jsonResponse(http.StatusOK, user)
+}
+
+func deleteUser(req *Request) RestAPIResponse {
+	id, errResp := userID(req)
+	if errResp != nil {
+		return *errResp
+	}
+	if err := userStore.Delete(id); err != nil {
+		return storeError(err)
+	}
+	log.Printf("Deleted user %d", id)
+	broker.Publish("/api/users", "deleted", map[string]int{"id": id})
+	return RestAPIResponse{Status: http.StatusNoContent, Headers: Header{}}
+}
+
+// userID parses the {id} path parameter.
+func userID(req *Request) (int, *RestAPIResponse) {
+	id, err := strconv.Atoi(req.Param("id"))
+	if err != nil || id <= 0 {
+		resp := errorResponse(http.StatusBadRequest, "User id must be a positive integer")
+		return 0, &resp
+	}
+	return id, nil
+}
+
+// decodeUserInput reads the request body as a user object, rejecting
+// anything that is not a JSON object with known, correctly typed fields.
+func decodeUserInput(req *Request) (userInput, *RestAPIResponse) {
+	var input userInput
+	if _, ok := req.Body.(map[string]interface{}); !ok {
+		resp := errorResponse(http.StatusBadRequest, "Request body must be a JSON object")
+		return input, &resp
+	}
+
+	data, err := json.Marshal(req.Body)
+	if err == nil {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&input)
+	}
+	if err != nil {
+		resp := errorResponse(http.StatusBadRequest, "Invalid user: "+strings.TrimPrefix(err.Error(), "json: "))
+		return input, &resp
+	}
+	return input, nil
+}
+
+// applyUserInput validates input and copies it onto user. With required
+// set, every field must be present.
+func applyUserInput(user *User, input userInput, required bool) *RestAPIResponse {
+	problems := map[string]string{}
+
+	if input.Name != nil {
+		name := strings.TrimSpace(*input.Name)
+		switch {
+		case name == "":
+			problems["name"] = "must not be empty"
+		case utf8.RuneCountInString(name) > maxUserNameLength:
+			problems["name"] = "must be at most " + strconv.Itoa(maxUserNameLength) + " characters"
+		default:
+			user.Name = name
+		}
+	} else if required {
+		problems["name"] = "is required"
+	}
+
+	if input.Email != nil {
+		email := strings.TrimSpace(*input.Email)
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			problems["email"] = "must be a valid email address"
+		} else {
+			user.Email = email
+		}
+	} else if required {
+		problems["email"] = "is required"
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	resp := newProblem(http.StatusUnprocessableEntity, problemValidation, "Validation failed").With("fields", problems).Response()
+	return &resp
+}
+
+// storeError maps UserStore errors onto HTTP statuses.
+func storeError(err error) RestAPIResponse {
+	switch {
+	case errors.Is(err, errUserNotFound):
+		return errorResponse(http.StatusNotFound, "User not found")
+	case errors.Is(err, errEmailTaken):
+		return errorResponse(http.StatusConflict, "A user with this email already exists")
+	}
+	log.Printf("User store error: %v", err)
+	return errorResponse(http.StatusInternalServerError, "Storage error")
+}
+
+// queryInt parses an optional non-negative integer query parameter.
+func queryInt(req *Request, name string, fallback int) (int, error) {
+	value := req.Query.Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.New(name + " must be a non-negative integer")
+	}
+	return n, nil
+}
+
+// jsonResponse wraps body in a JSON RestAPIResponse.
+func jsonResponse(status int, body interface{}) RestAPIResponse {
+	return RestAPIResponse{
+		Status:  status,
+		Headers: Header{"Content-Type": {"application/json"}},
+		Body:    body,
+	}
+}